@@ -1,5 +1,10 @@
 package binaryxml
 
+import (
+	"bytes"
+	"encoding/xml"
+)
+
 type BinXMLType uint8
 
 const (
@@ -24,11 +29,118 @@ const (
 	serialend   BinXMLType = 127
 )
 
+// ----------------------------------------------------------------------------
+// Envelopes
+// ----------------------------------------------------------------------------
+
+// BixRequest is the envelope of a request. Data holds the request payload, which is
+// encoded as the Data element, so its type must not declare an XMLName other than
+// "Data". When decoding, Data must be set to a pointer to decode the payload into,
+// or to a *RawData to defer decoding until the payload type is known.
+type BixRequest struct {
+	XMLName     struct{}    `xml:"BixRequest"`
+	ToNamespace string      `xml:"toNamespace"`
+	Request     string      `xml:"request"`
+	MOID        uint64      `xml:"moid"`
+	MID         uint64      `xml:"mid"`
+	Data        interface{} `xml:"Data,omitempty"`
+}
+
+// BixResponse is the envelope of a response, with a payload handled as in BixRequest.
+type BixResponse struct {
+	XMLName       struct{}    `xml:"BixResponse"`
+	FromNamespace string      `xml:"fromNamespace"`
+	Request       string      `xml:"request"`
+	MOID          uint64      `xml:"moid"`
+	MID           uint64      `xml:"mid"`
+	Data          interface{} `xml:"Data,omitempty"`
+}
+
+// BixError is the envelope of a response reporting that a request failed. Code
+// classifies the failure, and is left out by peers that predate error codes.
 type BixError struct {
-	XMLName       struct{} `xml:"BixError"`
-	FromNamespace string   `xml:"fromNamespace"`
-	Request       string   `xml:"request"`
-	MOID          uint64   `xml:"moid"`
-	MID           uint64   `xml:"mid"`
-	Error         string   `xml:"error"`
+	XMLName       struct{}  `xml:"BixError"`
+	FromNamespace string    `xml:"fromNamespace"`
+	Request       string    `xml:"request"`
+	MOID          uint64    `xml:"moid"`
+	MID           uint64    `xml:"mid"`
+	Error         string    `xml:"error"`
+	Code          ErrorCode `xml:"code,omitempty"`
+}
+
+// ErrorCode classifies the failure reported by a BixError.
+type ErrorCode string
+
+const (
+	// The request failed for reasons only the server knows, such as a panic
+	ErrorCodeInternal ErrorCode = "internal"
+
+	// The request is malformed or its arguments are invalid, and will fail again
+	ErrorCodeInvalidRequest ErrorCode = "invalid-request"
+
+	// The request exceeds the server's decode limits, and will fail again
+	ErrorCodeLimitExceeded ErrorCode = "limit-exceeded"
+
+	// The request refers to something that doesn't exist
+	ErrorCodeNotFound ErrorCode = "not-found"
+
+	// The server can't serve the request for now, such as while it starts or stops
+	ErrorCodeUnavailable ErrorCode = "unavailable"
+
+	// The request ran out of time
+	ErrorCodeTimeout ErrorCode = "timeout"
+
+	// The server is short of resources, such as under too much load
+	ErrorCodeOverloaded ErrorCode = "overloaded"
+)
+
+// Retryable reports whether a request that failed with code may succeed if sent
+// again. Failures without a code, from peers that predate error codes, aren't.
+func (code ErrorCode) Retryable() bool {
+	return code == ErrorCodeUnavailable || code == ErrorCodeTimeout || code == ErrorCodeOverloaded
+}
+
+// BixHello is the payload of the optional handshake frame, flagged
+// messages.ControlHello, that a client sends before its first request and the
+// server answers. Params holds the param bits the sender understands, and
+// MaxMessageSize the largest message it accepts. A server rejecting the client sets
+// Error in its answer, and closes the connection.
+type BixHello struct {
+	XMLName        struct{} `xml:"BixHello"`
+	Version        uint32   `xml:"version"`
+	Params         uint8    `xml:"params"`
+	MaxMessageSize uint32   `xml:"maxMessageSize"`
+	Identity       string   `xml:"identity"`
+	Error          string   `xml:"error,omitempty"`
+}
+
+// NewResponse returns a response to req carrying data.
+func (req *BixRequest) NewResponse(data interface{}) *BixResponse {
+	return &BixResponse{FromNamespace: req.ToNamespace, Request: req.Request, MOID: req.MOID, MID: req.MID, Data: data}
+}
+
+// NewError returns an error response to req.
+func (req *BixRequest) NewError(message string) *BixError {
+	return &BixError{FromNamespace: req.ToNamespace, Request: req.Request, MOID: req.MOID, MID: req.MID, Error: message}
+}
+
+// NewErrorWithCode returns an error response to req classified by code.
+func (req *BixRequest) NewErrorWithCode(code ErrorCode, message string) *BixError {
+	bixError := req.NewError(message)
+	bixError.Code = code
+	return bixError
+}
+
+// RawData captures an envelope payload without decoding it.
+type RawData struct {
+	XML []byte `xml:",innerxml"`
+}
+
+// Decode decodes the captured payload into v.
+func (data *RawData) Decode(v interface{}) error {
+	var buffer bytes.Buffer
+	buffer.WriteString("<Data>")
+	buffer.Write(data.XML)
+	buffer.WriteString("</Data>")
+	return xml.Unmarshal(buffer.Bytes(), v)
 }
@@ -0,0 +1,84 @@
+package binaryxml_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+type envelopeQuery struct {
+	Namespace string `xml:"namespace"`
+	Interval  uint32 `xml:"interval"`
+}
+
+func encodeEnvelope(t *testing.T, v interface{}) []byte {
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	assert.NoError(t, binaryxml.Encode(v, writer))
+	writer.Flush()
+	return buffer.Bytes()
+}
+
+func TestEnvelopeEncode(t *testing.T) {
+	assert := assert.New(t)
+
+	// Payload by value
+	req := binaryxml.BixRequest{ToNamespace: "SubscriptionManager", Request: "Subscribe", MOID: 2, MID: 3, Data: envelopeQuery{Namespace: "Common_CPU", Interval: 60}}
+	xml, err := binaryxml.ToXML(encodeEnvelope(t, req))
+	assert.NoError(err)
+	expected := "<BixRequest><toNamespace>SubscriptionManager</toNamespace><request>Subscribe</request><moid>2</moid><mid>3</mid><Data><namespace>Common_CPU</namespace><interval>60</interval></Data></BixRequest>"
+	assert.Equal(expected, xml)
+
+	// Payload by pointer
+	req.Data = &envelopeQuery{Namespace: "Common_CPU", Interval: 60}
+	xml, err = binaryxml.ToXML(encodeEnvelope(t, req))
+	assert.NoError(err)
+	assert.Equal(expected, xml)
+
+	// No payload
+	req.Data = nil
+	xml, err = binaryxml.ToXML(encodeEnvelope(t, req))
+	assert.NoError(err)
+	assert.Equal("<BixRequest><toNamespace>SubscriptionManager</toNamespace><request>Subscribe</request><moid>2</moid><mid>3</mid></BixRequest>", xml)
+}
+
+func TestEnvelopeDecode(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML := encodeEnvelope(t, binaryxml.BixRequest{ToNamespace: "SubscriptionManager", Request: "Subscribe", MOID: 2, MID: 3, Data: envelopeQuery{Namespace: "Common_CPU", Interval: 60}})
+
+	// Caller-supplied payload
+	var query envelopeQuery
+	req := binaryxml.BixRequest{Data: &query}
+	assert.NoError(binaryxml.Decode(binaryXML, &req))
+	assert.Equal("SubscriptionManager", req.ToNamespace)
+	assert.Equal(uint64(3), req.MID)
+	assert.Equal(envelopeQuery{Namespace: "Common_CPU", Interval: 60}, query)
+
+	// Deferred payload
+	var raw binaryxml.RawData
+	req = binaryxml.BixRequest{Data: &raw}
+	assert.NoError(binaryxml.Decode(binaryXML, &req))
+	query = envelopeQuery{}
+	assert.NoError(raw.Decode(&query))
+	assert.Equal(envelopeQuery{Namespace: "Common_CPU", Interval: 60}, query)
+}
+
+func TestEnvelopeReplies(t *testing.T) {
+	assert := assert.New(t)
+	req := binaryxml.BixRequest{ToNamespace: "SubscriptionManager", Request: "Subscribe", MOID: 2, MID: 3}
+
+	res := req.NewResponse(envelopeQuery{Interval: 5})
+	assert.Equal("SubscriptionManager", res.FromNamespace)
+	assert.Equal("Subscribe", res.Request)
+	assert.Equal(uint64(2), res.MOID)
+	assert.Equal(uint64(3), res.MID)
+	assert.Equal(envelopeQuery{Interval: 5}, res.Data)
+
+	bixError := req.NewError("failed")
+	xml, err := binaryxml.ToXML(encodeEnvelope(t, bixError))
+	assert.NoError(err)
+	assert.Equal("<BixError><fromNamespace>SubscriptionManager</fromNamespace><request>Subscribe</request><moid>2</moid><mid>3</mid><error>failed</error></BixError>", xml)
+}
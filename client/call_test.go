@@ -0,0 +1,199 @@
+package client_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/docktermj/go-logger/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCall(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+
+	type MyRequest struct {
+		XMLName     struct{} `xml:"BixRequest"`
+		Request     string   `xml:"request"`
+		ToNamespace string   `xml:"toNamespace"`
+	}
+
+	type MyResponse struct {
+		XMLName       struct{} `xml:"BixResponse"`
+		FromNamespace string   `xml:"fromNamespace"`
+		Request       string   `xml:"request"`
+	}
+
+	// Create a server that echoes the request fields
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		var param uint8
+		var binaryXML []byte
+		if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+			return
+		}
+		var myReq MyRequest
+		if err := binaryxml.Decode(binaryXML, &myReq); err != nil {
+			return
+		}
+
+		myRes := MyResponse{FromNamespace: myReq.ToNamespace, Request: myReq.Request}
+		var buffer bytes.Buffer
+		writer := bufio.NewWriter(&buffer)
+		if err := binaryxml.Encode(myRes, writer); err != nil {
+			return
+		}
+		writer.Flush()
+
+		writer = bufio.NewWriter(conn)
+		messages.WriteMessage(writer, messages.ParamResponse, buffer.Bytes())
+		writer.Flush()
+		time.Sleep(200 * time.Millisecond)
+	}()
+
+	// Create a client
+	client, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var myRes MyResponse
+	assert.NoError(client.Call(ctx, MyRequest{ToNamespace: "foo", Request: "bar"}, &myRes))
+	assert.Equal("foo", myRes.FromNamespace)
+	assert.Equal("bar", myRes.Request)
+
+	// A cancelled context fails without sending
+	cancel()
+	assert.Equal(context.Canceled, client.Call(ctx, MyRequest{}, &myRes))
+}
+
+func TestCallsCorrelateByMID(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+
+	// Create a server answering two requests in reverse order
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+		var mids []uint64
+		for len(mids) < 2 {
+			var param uint8
+			var binaryXML []byte
+			if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+				return
+			}
+			var req subscribeRequest
+			if err := binaryxml.Decode(binaryXML, &req); err != nil {
+				return
+			}
+			mids = append(mids, req.MID)
+		}
+		for i := len(mids) - 1; i >= 0; i-- {
+			writeSubscribeResponse(writer, messages.ParamResponse, subscribeResponse{MID: mids[i], Value: uint32(mids[i] * 10)})
+		}
+		time.Sleep(200 * time.Millisecond)
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Close()
+
+	// Each call gets the response carrying its mid
+	values := make(chan [2]uint64, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			mid := bixClient.NextMID()
+			var res subscribeResponse
+			if err := bixClient.Call(context.Background(), subscribeRequest{ToNamespace: "foo", Request: "Get", MID: mid}, &res); err != nil {
+				values <- [2]uint64{mid, 0}
+				return
+			}
+			values <- [2]uint64{mid, uint64(res.Value)}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case value := <-values:
+			assert.Equal(value[0]*10, value[1])
+		case <-time.After(time.Second):
+			assert.Fail("Call did not return")
+		}
+	}
+}
+
+func TestCallTimeoutLeavesConnectionUsable(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+
+	// Create a server answering the second request, and then the first one late
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+		var param uint8
+		var binaryXML []byte
+		for i := 0; i < 2; i++ {
+			if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+				return
+			}
+		}
+		writeSubscribeResponse(writer, messages.ParamResponse, subscribeResponse{MID: 2, Value: 2})
+		writeSubscribeResponse(writer, messages.ParamResponse, subscribeResponse{MID: 1, Value: 1})
+		time.Sleep(200 * time.Millisecond)
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var res subscribeResponse
+	assert.Equal(context.DeadlineExceeded, bixClient.Call(ctx, subscribeRequest{ToNamespace: "foo", Request: "Get", MID: 1}, &res))
+
+	// The timed out call didn't break the connection
+	assert.NoError(bixClient.Call(context.Background(), subscribeRequest{ToNamespace: "foo", Request: "Get", MID: 2}, &res))
+	assert.Equal(uint32(2), res.Value)
+	select {
+	case <-bixClient.Done():
+		assert.Fail("Client closed")
+	default:
+	}
+}
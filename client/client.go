@@ -3,32 +3,123 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BixData/binaryxml"
 	"github.com/BixData/binaryxml/messages"
 	"github.com/docktermj/go-logger/logger"
 )
 
+// ErrClosed fails sends and receives on a closed client.
+var ErrClosed = errors.New("Client closed")
+
 // ----------------------------------------------------------------------------
 
+// Client exchanges messages with a router. It is safe for concurrent use: sends are
+// serialized, and so are receives. Messages are read by the receiving goroutine,
+// until a call, a handshake, a subscription or keepalives hand reading over to a
+// background reader.
 type Client struct {
+	// Time the background reader started waiting for a message, in nanoseconds since
+	// the epoch, or 0. Accessed atomically; kept first for 64-bit alignment.
+	waitingSince int64
+
+	// Last mid returned by NextMID. Accessed atomically.
+	mid uint64
+
+	// Set while a pong is being sent. Accessed atomically.
+	ponging int32
+
 	Conn   net.Conn
 	Reader *bufio.Reader
 	Writer *bufio.Writer
+
+	// Encoding of sent messages. Received messages are decoded whatever their
+	// checksum and compression.
+	messages.Options
+
+	// Keepalives. When KeepaliveInterval is set, messages are read in the background
+	// and the server is pinged every KeepaliveInterval. If no message arrives for
+	// KeepaliveTimeout while waiting for one, which defaults to three intervals, the
+	// connection is closed and pending receives fail with ErrKeepaliveTimeout.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// Largest message the server accepts, from its hello, or 0 if unknown. Guarded by
+	// writeLock.
+	peerMaxMessageSize uint32
+
+	writeLock     sync.Mutex
+	readLock      sync.Mutex
+	lock          sync.Mutex
+	reader        *messages.Reader
+	inbox         chan Message
+	readErr       error
+	timedOut      bool
+	subscriptions map[uint64]*subscription
+	calls         map[uint64]chan Message
+	hello         chan Message
+	done          chan struct{}
+	closeOnce     sync.Once
+	closeErr      error
 }
 
+// Close closes the connection, unblocking pending sends and receives, which then
+// fail with ErrClosed. Closing a client again does nothing, and returns the result
+// of the first Close.
 func (self *Client) Close() error {
-	return self.Close()
+	self.closeOnce.Do(func() {
+		self.lock.Lock()
+		close(self.doneChannel())
+		self.lock.Unlock()
+		self.closeErr = self.Conn.Close()
+	})
+	return self.closeErr
+}
+
+// Done returns a channel closed once the client is closed, by Close or because the
+// background reader found the connection dead.
+func (self *Client) Done() <-chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.doneChannel()
+}
+
+func (self *Client) closed() bool {
+	select {
+	case <-self.Done():
+		return true
+	default:
+		return false
+	}
 }
 
 func (self *Client) SendRaw(param uint8, binaryXML []byte) error {
-	if err := messages.WriteMessage(self.Writer, param, binaryXML); err != nil {
-		return err
+	if self.closed() {
+		return ErrClosed
+	}
+	self.startKeepalive()
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if max := self.peerMaxMessageSize; max != 0 && param&messages.ParamControl == 0 && uint64(len(binaryXML)) > uint64(max) {
+		return &messages.TooLongError{Length: uint32(len(binaryXML)), Max: max}
+	}
+	writer := messages.NewWriter(self.Writer)
+	writer.Options = self.Options
+	err := writer.WriteMessage(param, binaryXML)
+	if err == nil {
+		err = self.Writer.Flush()
 	}
-	return self.Writer.Flush()
+	if err != nil && self.closed() {
+		return ErrClosed
+	}
+	return err
 }
 
 func (self *Client) Send(param uint8, req interface{}) error {
@@ -42,36 +133,224 @@ func (self *Client) Send(param uint8, req interface{}) error {
 	return self.SendRaw(param, binaryXML)
 }
 
+// ReceiveMessage reads the next message into a pooled buffer, which the caller must
+// Release. Once a subscription has been started, messages are read in the background
+// and only those not correlated to a subscription are returned here; up to 64 of
+// them wait to be received, and later ones are dropped. A server rejecting the
+// client with a hello is reported as an error.
+func (self *Client) ReceiveMessage() (*messages.Message, error) {
+	msg, err := self.receive()
+	if err != nil {
+		return nil, err
+	}
+	if err := helloError(msg); err != nil {
+		msg.Release()
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (self *Client) receive() (*messages.Message, error) {
+	if self.closed() {
+		return nil, ErrClosed
+	}
+	self.startKeepalive()
+	inbox, msg, err := self.receiveForeground()
+	if inbox == nil {
+		return msg, err
+	}
+	queued, ok := <-inbox
+	if !ok {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		return nil, self.readErr
+	}
+	if queued.Err != nil {
+		return nil, queued.Err
+	}
+	return queued.pooled, nil
+}
+
+// ReceiveRaw reads the next message into binaryXML, reusing the capacity of the
+// slice it points to.
 func (self *Client) ReceiveRaw(param *uint8, binaryXML *[]byte) error {
-	return messages.ReadMessage(self.Reader, param, binaryXML)
+	msg, err := self.ReceiveMessage()
+	if err != nil {
+		return err
+	}
+	defer msg.Release()
+	*param = msg.Param
+	*binaryXML = append((*binaryXML)[:0], msg.BinaryXML...)
+	return nil
 }
 
+// Receive reads the next message and decodes it into res. A BixError received
+// instead is returned as a *RemoteError, unless res is a *binaryxml.BixError. Other
+// errors keep their types, such as a *messages.ChecksumError for a corrupted frame
+// or a *binaryxml.SyntaxError for a malformed document.
 func (self *Client) Receive(param *uint8, res interface{}) error {
-	var binaryXML []byte
-	if err := self.ReceiveRaw(param, &binaryXML); err != nil {
+	msg, err := self.ReceiveMessage()
+	if err != nil {
 		return err
 	}
-	err := binaryxml.Decode(binaryXML, &res)
+	defer msg.Release()
+	*param = msg.Param
+	return decodeResponse(msg.BinaryXML, res)
+}
+
+// decodeResponse decodes binaryXML into res, or returns the BixError it holds as a
+// *RemoteError, unless res is a *binaryxml.BixError.
+func decodeResponse(binaryXML []byte, res interface{}) error {
+	// Tell errors apart by their root element, before decoding the expected type
+	name, err := binaryxml.RootElementName(binaryXML)
 	if err != nil {
+		return err
+	}
+	if _, wantsError := res.(*binaryxml.BixError); name == "BixError" && !wantsError {
 		var bixError binaryxml.BixError
-		err2 := binaryxml.Decode(binaryXML, &bixError)
-		if err2 == nil && bixError.Error != "" {
-			return errors.New(bixError.Error)
+		if err := binaryxml.Decode(binaryXML, &bixError); err != nil {
+			return err
 		}
+		return newRemoteError(&bixError)
 	}
-	return err
+	return binaryxml.Decode(binaryXML, &res)
+}
+
+// Call sends req and waits for the response correlated to it by mid, which it
+// decodes into res like Receive. Responses are read in the background, so that
+// concurrent calls and subscriptions each get their own. Waiting stops once ctx is
+// done, without affecting other users of the connection. A call fails if another
+// call or an active subscription already waits for the same mid; use NextMID to
+// number requests.
+func (self *Client) Call(ctx context.Context, req interface{}, res interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	if err := binaryxml.Encode(req, writer); err != nil {
+		return err
+	}
+	writer.Flush()
+	binaryXML := buffer.Bytes()
+	_, mid, err := binaryxml.EnvelopeMID(binaryXML)
+	if err != nil {
+		return err
+	}
+
+	// Register call before sending, so that the response can't be missed
+	response := make(chan Message, 1)
+	self.lock.Lock()
+	self.startReading()
+	if self.readErr != nil {
+		err := self.readErr
+		self.lock.Unlock()
+		return err
+	}
+	if _, exists := self.calls[mid]; exists {
+		self.lock.Unlock()
+		return errors.New("A call with the same mid is already pending")
+	}
+	if sub, exists := self.subscriptions[mid]; exists && !sub.cancelled {
+		self.lock.Unlock()
+		return errors.New("A subscription with the same mid is already active")
+	}
+	self.calls[mid] = response
+	self.lock.Unlock()
+	defer self.endCall(mid, response)
+
+	if err := self.SendRaw(0, binaryXML); err != nil {
+		return err
+	}
+	select {
+	case msg := <-response:
+		if msg.Err != nil {
+			return msg.Err
+		}
+		defer msg.pooled.Release()
+		return decodeResponse(msg.BinaryXML, res)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NextMID returns a mid not returned before by this client, for numbering requests.
+func (self *Client) NextMID() uint64 {
+	return atomic.AddUint64(&self.mid, 1)
+}
+
+// endCall stops waiting for the response to a call, releasing it if it arrived
+// after all.
+func (self *Client) endCall(mid uint64, response chan Message) {
+	self.lock.Lock()
+	if self.calls[mid] == response {
+		delete(self.calls, mid)
+	}
+	self.lock.Unlock()
+	select {
+	case msg := <-response:
+		if msg.pooled != nil {
+			msg.pooled.Release()
+		}
+	default:
+	}
+}
+
+// receiveForeground reads the next message from the connection, unless reading was
+// handed over to the background reader, in which case it returns the inbox of the
+// background reader.
+func (self *Client) receiveForeground() (chan Message, *messages.Message, error) {
+	self.readLock.Lock()
+	defer self.readLock.Unlock()
+	self.lock.Lock()
+	inbox := self.inbox
+	reader := self.messageReader()
+	self.lock.Unlock()
+	if inbox != nil {
+		return inbox, nil, nil
+	}
+	for {
+		msg, err := reader.Next()
+		if err != nil {
+			if self.closed() {
+				err = ErrClosed
+			}
+			return nil, nil, err
+		}
+		if !self.control(msg) {
+			return nil, msg, nil
+		}
+	}
+}
+
+// doneChannel returns the channel closed by Close. Must be called with self.lock
+// held.
+func (self *Client) doneChannel() chan struct{} {
+	if self.done == nil {
+		self.done = make(chan struct{})
+	}
+	return self.done
+}
+
+// messageReader returns the reader of messages from self.Reader. Must be called with
+// self.lock held.
+func (self *Client) messageReader() *messages.Reader {
+	if self.reader == nil {
+		self.reader = messages.NewReader(self.Reader)
+	}
+	return self.reader
 }
 
 // ----------------------------------------------------------------------------
 
 func Connect(host string, port int) (*Client, error) {
-	addr := fmt.Sprintf("%s:%d", host, port)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		logger.Warnf("Failed connecting to %s: %v", addr, err)
 		return nil, err
 	}
 	logger.Debugf("Connected to %s", addr)
-	client := Client{Conn: conn, Reader: bufio.NewReader(conn), Writer: bufio.NewWriter(conn)}
+	client := Client{Conn: conn, Reader: bufio.NewReader(conn), Writer: bufio.NewWriter(conn), Options: messages.NewOptions(), done: make(chan struct{})}
 	return &client, nil
 }
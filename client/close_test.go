@@ -0,0 +1,137 @@
+package client_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoServer listens for a connection echoing every message
+func echoServer(t *testing.T) (net.Listener, int) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+		for {
+			var param uint8
+			var binaryXML []byte
+			if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+				return
+			}
+			messages.WriteMessage(writer, messages.ParamResponse, binaryXML)
+			if reader.Buffered() == 0 {
+				writer.Flush()
+			}
+		}
+	}()
+	return listener, listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	listener, port := echoServer(t)
+	defer listener.Close()
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+
+	// Pending receives are unblocked
+	received := make(chan error, 1)
+	go func() {
+		_, err := bixClient.ReceiveMessage()
+		received <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(bixClient.Close())
+	assert.Equal(client.ErrClosed, <-received)
+	assert.True(closedWithin(doneChannel(bixClient), time.Second))
+
+	// Closing again does nothing
+	assert.NoError(bixClient.Close())
+	assert.Equal(client.ErrClosed, bixClient.SendRaw(0, []byte("late")))
+	_, err = bixClient.ReceiveMessage()
+	assert.Equal(client.ErrClosed, err)
+}
+
+func TestCloseConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	listener, port := echoServer(t)
+	defer listener.Close()
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+
+	const senders, count = 4, 50
+	var wait sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wait.Add(1)
+		go func(sender int) {
+			defer wait.Done()
+			for j := 0; j < count; j++ {
+				assert.NoError(bixClient.SendRaw(0, []byte(fmt.Sprintf("%d-%d", sender, j))))
+			}
+		}(i)
+	}
+
+	// Every message comes back whole, whichever receiver gets it
+	received := make(chan string, senders*count)
+	var receivers sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			for {
+				msg, err := bixClient.ReceiveMessage()
+				if err != nil {
+					assert.Equal(client.ErrClosed, err)
+					return
+				}
+				received <- string(msg.BinaryXML)
+				msg.Release()
+			}
+		}()
+	}
+	wait.Wait()
+	seen := make(map[string]bool)
+	for len(seen) < senders*count {
+		select {
+		case msg := <-received:
+			seen[msg] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Received %d of %d messages", len(seen), senders*count)
+		}
+	}
+
+	// Closing unblocks the receivers, concurrently with other Close calls
+	for i := 0; i < 2; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			bixClient.Close()
+		}()
+	}
+	wait.Wait()
+	receivers.Wait()
+}
+
+func doneChannel(bixClient *client.Client) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		<-bixClient.Done()
+		close(done)
+	}()
+	return done
+}
@@ -16,17 +16,26 @@ func TestConnect(t *testing.T) {
 	assert.NoError(err)
 	port := listener.Addr().(*net.TCPAddr).Port
 
-	accepted := false
+	accepted := make(chan struct{})
 	go func() {
 		if _, err := listener.Accept(); err == nil {
-			accepted = true
+			close(accepted)
 		}
 	}()
 
 	_, err = client.Connect("127.0.0.1", port)
 	assert.NoError(err)
 
-	time.Sleep(20 * time.Millisecond)
-	assert.True(accepted)
+	assert.True(closedWithin(accepted, time.Second))
 	assert.NoError(listener.Close())
 }
+
+// closedWithin returns whether ch gets closed before timeout elapses
+func closedWithin(ch chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
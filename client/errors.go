@@ -0,0 +1,49 @@
+package client
+
+import (
+	"github.com/BixData/binaryxml"
+)
+
+// RemoteError is a BixError received in response to a request, reporting that the
+// server failed serving it.
+type RemoteError struct {
+	// Namespace and request of the failed request
+	Namespace string
+	Request   string
+
+	// Ids the failed request was sent with
+	MOID uint64
+	MID  uint64
+
+	// Classification of the failure, empty when the server predates error codes
+	Code binaryxml.ErrorCode
+
+	// Message reported by the server
+	Message string
+}
+
+func newRemoteError(bixError *binaryxml.BixError) *RemoteError {
+	return &RemoteError{
+		Namespace: bixError.FromNamespace,
+		Request:   bixError.Request,
+		MOID:      bixError.MOID,
+		MID:       bixError.MID,
+		Code:      bixError.Code,
+		Message:   bixError.Error,
+	}
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the code of the failure, so that routers relaying the error send
+// it along.
+func (e *RemoteError) ErrorCode() binaryxml.ErrorCode {
+	return e.Code
+}
+
+// Retryable reports whether the request may succeed if sent again.
+func (e *RemoteError) Retryable() bool {
+	return e.Code.Retryable()
+}
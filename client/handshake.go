@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/messages"
+)
+
+// ----------------------------------------------------------------------------
+// Handshake
+// ----------------------------------------------------------------------------
+
+// Handshake sends a hello announcing the client's protocol version, capabilities and
+// identity, and returns the server's answer, whose Version is the protocol version
+// both ends speak. It must be called before any other message is sent. Servers
+// predating handshakes don't answer, so ctx should carry a deadline when talking to
+// them. The hello advertises the client's Checksum and Compression as the only ones
+// it accepts besides crc32 and none, which it falls back to unless the server
+// accepts them too. Later messages larger than the server accepts fail to send with a
+// *messages.TooLongError.
+func (self *Client) Handshake(ctx context.Context, identity string) (*binaryxml.BixHello, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Wait for the answer through the background reader, so that giving up on it
+	// leaves the connection usable
+	response := make(chan Message, 1)
+	self.lock.Lock()
+	self.startReading()
+	if self.readErr != nil {
+		err := self.readErr
+		self.lock.Unlock()
+		return nil, err
+	}
+	if self.hello != nil {
+		self.lock.Unlock()
+		return nil, errors.New("A handshake is already pending")
+	}
+	self.hello = response
+	maxMessageSize := self.messageReader().MaxMessageSize
+	self.lock.Unlock()
+	defer self.endHandshake(response)
+
+	self.writeLock.Lock()
+	params := self.Options.HelloParams()
+	self.writeLock.Unlock()
+	hello := binaryxml.BixHello{Version: messages.ProtocolVersion, Params: params, MaxMessageSize: maxMessageSize, Identity: identity}
+	if err := self.Send(messages.ControlHello, hello); err != nil {
+		return nil, err
+	}
+	var msg Message
+	select {
+	case msg = <-response:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if msg.Err != nil {
+		return nil, msg.Err
+	}
+	defer msg.pooled.Release()
+	var answer binaryxml.BixHello
+	if err := binaryxml.Decode(msg.BinaryXML, &answer); err != nil {
+		return nil, err
+	}
+	if answer.Error != "" {
+		return &answer, errors.New(answer.Error)
+	}
+	if answer.Version == 0 || answer.Version > messages.ProtocolVersion {
+		return &answer, fmt.Errorf("Unsupported protocol version %d", answer.Version)
+	}
+
+	self.writeLock.Lock()
+	self.peerMaxMessageSize = answer.MaxMessageSize
+	if messages.HelloCompression(answer.Params) != self.Compression {
+		self.Compression = messages.CompressionNone
+	}
+	if messages.HelloChecksum(answer.Params) != self.Checksum {
+		self.Checksum = messages.ChecksumCRC32
+	}
+	self.writeLock.Unlock()
+	return &answer, nil
+}
+
+// endHandshake stops waiting for the server's hello, releasing it if it arrived
+// after all.
+func (self *Client) endHandshake(response chan Message) {
+	self.lock.Lock()
+	if self.hello == response {
+		self.hello = nil
+	}
+	self.lock.Unlock()
+	select {
+	case msg := <-response:
+		if msg.pooled != nil {
+			msg.pooled.Release()
+		}
+	default:
+	}
+}
+
+// helloError returns the error a server rejected the client with, when msg is a
+// hello sent outside of a handshake.
+func helloError(msg *messages.Message) error {
+	if msg.Param != messages.ControlHello {
+		return nil
+	}
+	var answer binaryxml.BixHello
+	if err := binaryxml.Decode(msg.BinaryXML, &answer); err != nil {
+		return err
+	}
+	if answer.Error == "" {
+		return errors.New("Unexpected hello from the server")
+	}
+	return errors.New(answer.Error)
+}
@@ -0,0 +1,106 @@
+package client_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	// Create a server answering hellos, accepting zstd compression only
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	received := make(chan binaryxml.BixHello, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var param uint8
+		var binaryXML []byte
+		if err := messages.ReadMessage(conn, &param, &binaryXML); err != nil || param != messages.ControlHello {
+			return
+		}
+		var hello binaryxml.BixHello
+		binaryxml.Decode(binaryXML, &hello)
+		received <- hello
+
+		answer := binaryxml.BixHello{Version: 1, Params: messages.ParamResponse | messages.ParamMore | messages.CompressionZstd.Param(), MaxMessageSize: 1000, Identity: "router"}
+		var buffer bytes.Buffer
+		writer := bufio.NewWriter(&buffer)
+		binaryxml.Encode(answer, writer)
+		writer.Flush()
+		messages.WriteMessage(conn, messages.ControlHello, buffer.Bytes())
+
+		// Wait for the client to hang up
+		conn.Read(make([]byte, 1))
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Conn.Close()
+	bixClient.Compression = messages.CompressionGzip
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	answer, err := bixClient.Handshake(ctx, "collector")
+	assert.NoError(err)
+	assert.Equal(uint32(1), answer.Version)
+	assert.Equal(uint32(1000), answer.MaxMessageSize)
+	assert.Equal("router", answer.Identity)
+
+	hello := <-received
+	assert.Equal(messages.ProtocolVersion, hello.Version)
+	assert.Equal(messages.SupportedParams&^(messages.ParamCompressionMask|messages.ParamChecksumMask)|messages.CompressionGzip.Param(), hello.Params)
+	assert.Equal(messages.CompressionGzip, messages.HelloCompression(hello.Params))
+	assert.Equal(messages.DefaultMaxMessageSize, hello.MaxMessageSize)
+	assert.Equal("collector", hello.Identity)
+
+	// The server doesn't accept gzip
+	assert.Equal(messages.CompressionNone, bixClient.Compression)
+
+	// Nor messages larger than its limit
+	err = bixClient.SendRaw(0, make([]byte, 1001))
+	assert.Equal(&messages.TooLongError{Length: 1001, Max: 1000}, err)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// Create a server predating handshakes, which never answers
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 1024))
+		conn.Read(make([]byte, 1))
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = bixClient.Handshake(ctx, "collector")
+	assert.Error(err)
+}
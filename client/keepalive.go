@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/docktermj/go-logger/logger"
+)
+
+// ErrKeepaliveTimeout fails pending receives once the server hasn't been heard from
+// for KeepaliveTimeout.
+var ErrKeepaliveTimeout = errors.New("Keepalive timeout; the server stopped responding")
+
+// ----------------------------------------------------------------------------
+// Keepalives
+// ----------------------------------------------------------------------------
+
+// startKeepalive hands reading over to the background reader, which starts
+// keepalives, when KeepaliveInterval is set.
+func (self *Client) startKeepalive() {
+	if self.KeepaliveInterval <= 0 {
+		return
+	}
+	self.lock.Lock()
+	self.startReading()
+	self.lock.Unlock()
+}
+
+// keepalive pings the server every KeepaliveInterval, and closes the connection once
+// the background reader has waited for a message for longer than KeepaliveTimeout,
+// until the background reader stops.
+func (self *Client) keepalive(stopped <-chan struct{}) {
+	interval := self.KeepaliveInterval
+	timeout := self.KeepaliveTimeout
+	if timeout <= 0 {
+		timeout = 3 * interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+		}
+		waitingSince := atomic.LoadInt64(&self.waitingSince)
+		if waitingSince != 0 && time.Since(time.Unix(0, waitingSince)) >= timeout {
+			logger.Warnf("No message from %s for %v, closing connection", self.Conn.RemoteAddr(), timeout)
+			self.lock.Lock()
+			self.timedOut = true
+			self.lock.Unlock()
+			self.Close()
+			return
+		}
+		if err := self.SendRaw(messages.ControlPing, nil); err != nil {
+			logger.Debugf("Failed pinging %s: %v", self.Conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// control answers pings and discards pongs, returning whether msg was one of them.
+// Handled messages are released.
+func (self *Client) control(msg *messages.Message) bool {
+	switch msg.Param {
+	case messages.ControlPing:
+		self.pong(msg.BinaryXML)
+	case messages.ControlPong:
+	default:
+		return false
+	}
+	msg.Release()
+	return true
+}
+
+// pong answers a ping with the same payload, from a goroutine of its own so that
+// reading isn't held up by a blocked write. Pings arriving while a pong is still
+// being sent are dropped.
+func (self *Client) pong(payload []byte) {
+	if !atomic.CompareAndSwapInt32(&self.ponging, 0, 1) {
+		return
+	}
+	payload = append([]byte(nil), payload...)
+	go func() {
+		defer atomic.StoreInt32(&self.ponging, 0)
+		if err := self.SendRaw(messages.ControlPong, payload); err != nil {
+			logger.Debugf("Failed answering ping from %s: %v", self.Conn.RemoteAddr(), err)
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+package client_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepalive(t *testing.T) {
+	assert := assert.New(t)
+
+	// Create a server answering pings, and then sending a message
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for pings := 0; pings < 10; {
+			var param uint8
+			var payload []byte
+			if err := messages.ReadMessage(conn, &param, &payload); err != nil {
+				return
+			}
+			if param == messages.ControlPing {
+				messages.WriteMessage(conn, messages.ControlPong, payload)
+				pings++
+			}
+		}
+		messages.WriteMessage(conn, messages.ParamResponse, []byte("alive"))
+
+		// Wait for the client to hang up
+		conn.Read(make([]byte, 1))
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Conn.Close()
+	bixClient.KeepaliveInterval = 10 * time.Millisecond
+	bixClient.KeepaliveTimeout = 30 * time.Millisecond
+
+	// Pongs keep the connection open beyond the timeout, and aren't received
+	msg, err := bixClient.ReceiveMessage()
+	assert.NoError(err)
+	assert.Equal(messages.ParamResponse, msg.Param)
+	assert.Equal("alive", string(msg.BinaryXML))
+	msg.Release()
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// Create a server that stops responding
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffer := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Conn.Close()
+	bixClient.KeepaliveInterval = 10 * time.Millisecond
+
+	// Pending receives fail once the timeout has elapsed
+	start := time.Now()
+	msg, err := bixClient.ReceiveMessage()
+	assert.Nil(msg)
+	assert.Equal(client.ErrKeepaliveTimeout, err)
+	assert.True(time.Since(start) >= 30*time.Millisecond)
+}
@@ -32,8 +32,8 @@ func TestReceiveError(t *testing.T) {
 	logger.Debugf("Listening on port %d", port)
 
 	var conn net.Conn
-	accepted := false
-	received := false
+	accepted := make(chan struct{})
+	received := make(chan struct{})
 	var listenerErr error
 	go func() {
 		if conn, listenerErr = listener.Accept(); listenerErr != nil {
@@ -41,7 +41,7 @@ func TestReceiveError(t *testing.T) {
 			return
 		}
 		defer conn.Close()
-		accepted = true
+		close(accepted)
 
 		// Read message
 		reader := bufio.NewReader(conn)
@@ -51,7 +51,7 @@ func TestReceiveError(t *testing.T) {
 			logger.Errorf("%v", listenerErr)
 			return
 		}
-		received = true
+		close(received)
 
 		// Prepare response
 		myRes := binaryxml.BixError{FromNamespace: "baz", Error: "567"}
@@ -76,17 +76,15 @@ func TestReceiveError(t *testing.T) {
 	}()
 
 	// Create a client
-	client, err := client.Connect("127.0.0.1", port)
+	bixClient, err := client.Connect("127.0.0.1", port)
 	assert.NoError(err)
 
-	time.Sleep(20 * time.Millisecond)
-	assert.True(accepted)
+	assert.True(closedWithin(accepted, time.Second))
 
 	// Prepare and send request
 	myRequest := MyRequest{ToNamespace: "foo", Request: "bar"}
-	assert.NoError(client.Send(0, myRequest))
-	time.Sleep(200 * time.Millisecond)
-	assert.True(received)
+	assert.NoError(bixClient.Send(0, myRequest))
+	assert.True(closedWithin(received, time.Second))
 
 	// Receive response
 	var param uint8
@@ -96,7 +94,15 @@ func TestReceiveError(t *testing.T) {
 		FromNamespace string   `xml:"fromNamespace"`
 	}
 	var myRes MyResponse
-	err = client.Receive(&param, &myRes)
+	err = bixClient.Receive(&param, &myRes)
 	assert.Error(err)
 	assert.Equal("567", err.Error())
+
+	// Servers predating error codes send none, so their errors aren't retryable
+	remoteErr, ok := err.(*client.RemoteError)
+	if assert.True(ok) {
+		assert.Equal("baz", remoteErr.Namespace)
+		assert.Equal("567", remoteErr.Message)
+		assert.False(remoteErr.Retryable())
+	}
 }
@@ -0,0 +1,53 @@
+package client_test
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	// Create a server sending two messages
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writer := bufio.NewWriter(conn)
+		messages.WriteMessage(writer, messages.ParamResponse, []byte("first"))
+		messages.WriteMessage(writer, messages.ParamResponse|messages.ParamMore, []byte("second"))
+		writer.Flush()
+
+		// Wait for the client to hang up
+		conn.Read(make([]byte, 1))
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Conn.Close()
+
+	msg, err := bixClient.ReceiveMessage()
+	assert.NoError(err)
+	assert.Equal(messages.ParamResponse, msg.Param)
+	assert.Equal("first", string(msg.BinaryXML))
+	msg.Release()
+
+	// ReceiveRaw copies into the caller's buffer
+	var param uint8
+	binaryXML := make([]byte, 0, 64)
+	assert.NoError(bixClient.ReceiveRaw(&param, &binaryXML))
+	assert.Equal(messages.ParamResponse|messages.ParamMore, param)
+	assert.Equal("second", string(binaryXML))
+	assert.Equal(64, cap(binaryXML))
+}
@@ -37,8 +37,8 @@ func TestReceiveRaw(t *testing.T) {
 	logger.Debugf("Listening on port %d", port)
 
 	var conn net.Conn
-	accepted := false
-	received := false
+	accepted := make(chan struct{})
+	received := make(chan struct{})
 	var listenerErr error
 	go func() {
 		if conn, listenerErr = listener.Accept(); listenerErr != nil {
@@ -46,7 +46,7 @@ func TestReceiveRaw(t *testing.T) {
 			return
 		}
 		defer conn.Close()
-		accepted = true
+		close(accepted)
 
 		// Read message
 		reader := bufio.NewReader(conn)
@@ -56,7 +56,7 @@ func TestReceiveRaw(t *testing.T) {
 			logger.Errorf("%v", listenerErr)
 			return
 		}
-		received = true
+		close(received)
 
 		// Prepare response
 		myRes := MyResponse{FromNamespace: "baz"}
@@ -84,8 +84,7 @@ func TestReceiveRaw(t *testing.T) {
 	client, err := client.Connect("127.0.0.1", port)
 	assert.NoError(err)
 
-	time.Sleep(20 * time.Millisecond)
-	assert.True(accepted)
+	assert.True(closedWithin(accepted, time.Second))
 
 	myRequest := MyRequest{ToNamespace: "foo", Request: "bar"}
 
@@ -97,8 +96,7 @@ func TestReceiveRaw(t *testing.T) {
 	// Send it
 	assert.NoError(client.SendRaw(0, buffer.Bytes()))
 
-	time.Sleep(200 * time.Millisecond)
-	assert.True(received)
+	assert.True(closedWithin(received, time.Second))
 
 	// Receive response
 	var param uint8
@@ -0,0 +1,64 @@
+package client_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/docktermj/go-logger/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveTypedErrors(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+
+	// Create a server sending a malformed document, then a corrupted frame
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	accepted := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Errorf("%v", err)
+			return
+		}
+		defer conn.Close()
+		close(accepted)
+
+		var buffer bytes.Buffer
+		messages.WriteMessage(&buffer, 0, []byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x09, 0x0d, 0x7f})
+		corrupted := buffer.Len() + 8
+		messages.WriteMessage(&buffer, 0, []byte("payload"))
+		buffer.Bytes()[corrupted]++
+		conn.Write(buffer.Bytes())
+		time.Sleep(time.Second)
+	}()
+
+	// Create a client
+	client, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer client.Close()
+	assert.True(closedWithin(accepted, time.Second))
+
+	type MyResponse struct {
+		XMLName struct{} `xml:"BixResponse"`
+	}
+	var param uint8
+	var myRes MyResponse
+	err = client.Receive(&param, &myRes)
+	assert.Equal(&binaryxml.UnknownElementIDError{Offset: 7, ID: 9}, err)
+
+	err = client.Receive(&param, &myRes)
+	checksumError, ok := err.(*messages.ChecksumError)
+	if assert.True(ok, "%v", err) {
+		assert.True(checksumError.Is(messages.ErrMalformed))
+	}
+}
@@ -0,0 +1,109 @@
+package client_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/docktermj/go-logger/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+var remoteErrorFixture = binaryxml.BixError{
+	FromNamespace: "foo",
+	Request:       "Subscribe",
+	MOID:          3,
+	MID:           7,
+	Error:         "shutting down",
+	Code:          binaryxml.ErrorCodeUnavailable,
+}
+
+// serveRemoteErrors answers every request with remoteErrorFixture
+func serveRemoteErrors(t *testing.T, listener net.Listener) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	if err := binaryxml.Encode(remoteErrorFixture, writer); err != nil {
+		logger.Errorf("%v", err)
+		return
+	}
+	writer.Flush()
+	for {
+		var param uint8
+		var binaryXML []byte
+		if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+			return
+		}
+		if err := messages.WriteMessage(conn, messages.ParamResponse, buffer.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func TestReceiveRemoteError(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	go serveRemoteErrors(t, listener)
+
+	bixClient, err := client.Connect("127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+	assert.NoError(err)
+	defer bixClient.Close()
+
+	// A type the error would decode into is not mistaken for a response
+	type lenientResponse struct {
+		MID   uint64 `xml:"mid"`
+		Error string `xml:"error"`
+	}
+	assert.NoError(bixClient.Send(0, subscribeRequest{ToNamespace: "foo", Request: "Subscribe", MOID: 3, MID: 7}))
+	var param uint8
+	var res lenientResponse
+	err = bixClient.Receive(&param, &res)
+	assert.Equal(&client.RemoteError{Namespace: "foo", Request: "Subscribe", MOID: 3, MID: 7, Code: binaryxml.ErrorCodeUnavailable, Message: "shutting down"}, err)
+	assert.EqualError(err, "shutting down")
+	assert.True(err.(*client.RemoteError).Retryable())
+	assert.Equal(lenientResponse{}, res)
+
+	// Errors decode as they are when asked for
+	assert.NoError(bixClient.Send(0, subscribeRequest{ToNamespace: "foo", Request: "Subscribe", MOID: 3, MID: 7}))
+	var bixError binaryxml.BixError
+	assert.NoError(bixClient.Receive(&param, &bixError))
+	assert.Equal(remoteErrorFixture, bixError)
+}
+
+func TestSubscribeRemoteError(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	go serveRemoteErrors(t, listener)
+
+	bixClient, err := client.Connect("127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+	assert.NoError(err)
+	defer bixClient.Close()
+
+	responses, cancel := bixClient.Subscribe(context.Background(), subscribeRequest{ToNamespace: "foo", Request: "Subscribe", MOID: 3, MID: 7})
+	defer cancel()
+	msg := <-responses
+	remoteErr, ok := msg.Err.(*client.RemoteError)
+	if assert.True(ok, "%v", msg.Err) {
+		assert.Equal("foo", remoteErr.Namespace)
+		assert.Equal(uint64(3), remoteErr.MOID)
+		assert.Equal(binaryxml.ErrorCodeUnavailable, remoteErr.Code)
+	}
+	_, open := <-responses
+	assert.False(open)
+}
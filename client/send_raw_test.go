@@ -26,15 +26,15 @@ func TestSendRaw(t *testing.T) {
 	logger.Debugf("Listening on port %d", port)
 
 	var conn net.Conn
-	accepted := false
-	received := false
+	accepted := make(chan struct{})
+	received := make(chan struct{})
 	var listenerErr error
 	go func() {
 		if conn, listenerErr = listener.Accept(); listenerErr != nil {
 			return
 		}
 		defer conn.Close()
-		accepted = true
+		close(accepted)
 
 		// Read message
 		reader := bufio.NewReader(conn)
@@ -43,7 +43,7 @@ func TestSendRaw(t *testing.T) {
 		if listenerErr = messages.ReadMessage(reader, &param, &binaryXML); listenerErr != nil {
 			return
 		}
-		received = true
+		close(received)
 
 	}()
 
@@ -51,8 +51,7 @@ func TestSendRaw(t *testing.T) {
 	client, err := client.Connect("127.0.0.1", port)
 	assert.NoError(err)
 
-	time.Sleep(20 * time.Millisecond)
-	assert.True(accepted)
+	assert.True(closedWithin(accepted, time.Second))
 
 	// Prepare a BinaryXML request
 	type MyRequest struct {
@@ -70,6 +69,5 @@ func TestSendRaw(t *testing.T) {
 	// Send it
 	assert.NoError(client.SendRaw(0, buffer.Bytes()))
 
-	time.Sleep(200 * time.Millisecond)
-	assert.True(received)
+	assert.True(closedWithin(received, time.Second))
 }
@@ -24,15 +24,15 @@ func TestSend(t *testing.T) {
 	logger.Debugf("Listening on port %d", port)
 
 	var conn net.Conn
-	accepted := false
-	received := false
+	accepted := make(chan struct{})
+	received := make(chan struct{})
 	var listenerErr error
 	go func() {
 		if conn, listenerErr = listener.Accept(); listenerErr != nil {
 			return
 		}
 		defer conn.Close()
-		accepted = true
+		close(accepted)
 
 		// Read message
 		reader := bufio.NewReader(conn)
@@ -41,7 +41,7 @@ func TestSend(t *testing.T) {
 		if listenerErr = messages.ReadMessage(reader, &param, &binaryXML); listenerErr != nil {
 			return
 		}
-		received = true
+		close(received)
 
 	}()
 
@@ -49,8 +49,7 @@ func TestSend(t *testing.T) {
 	client, err := client.Connect("127.0.0.1", port)
 	assert.NoError(err)
 
-	time.Sleep(20 * time.Millisecond)
-	assert.True(accepted)
+	assert.True(closedWithin(accepted, time.Second))
 
 	// Prepare a BinaryXML request
 	type MyRequest struct {
@@ -63,6 +62,5 @@ func TestSend(t *testing.T) {
 	// Send it
 	assert.NoError(client.Send(0, myRequest))
 
-	time.Sleep(200 * time.Millisecond)
-	assert.True(received)
+	assert.True(closedWithin(received, time.Second))
 }
@@ -0,0 +1,398 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/docktermj/go-logger/logger"
+)
+
+// UnsubscribeRequest is the request name sent to a subscription's namespace when
+// the subscription is cancelled. The unsubscribe request carries the moid and mid
+// of the original request.
+const UnsubscribeRequest = "Unsubscribe"
+
+const (
+	inboxSize        = 64
+	subscriptionSize = 16
+
+	// Time responses to a cancelled subscription are discarded for, waiting for the
+	// final one, before its mid can be reused in the meantime
+	cancelledSubscriptionTimeout = time.Minute
+)
+
+// ErrSubscriptionOverflow ends a subscription whose responses weren't consumed as fast
+// as they arrived. Responses are never waited on to be consumed, so that slow
+// subscribers don't hold up the responses to other requests.
+var ErrSubscriptionOverflow = errors.New("Subscription overflow; responses were not consumed in time")
+
+// ----------------------------------------------------------------------------
+// Subscription messages
+// ----------------------------------------------------------------------------
+
+// Message is a response delivered on a subscription channel. A Message with a
+// non-nil Err is always the last one delivered before the channel is closed.
+type Message struct {
+	Param     uint8
+	BinaryXML []byte
+	Err       error
+
+	// Buffer backing BinaryXML, for messages queued to ReceiveMessage
+	pooled *messages.Message
+}
+
+// ----------------------------------------------------------------------------
+// Subscription
+// ----------------------------------------------------------------------------
+
+type subscription struct {
+	header    binaryxml.BixRequest
+	responses chan Message
+	done      chan struct{}
+	lock      sync.Mutex
+	closeOnce sync.Once
+
+	// Set once cancelled, while responses to its mid are still discarded. Guarded by
+	// the client's lock.
+	cancelled bool
+}
+
+// newSubscription returns a subscription buffering up to subscriptionSize responses,
+// plus a final error.
+func newSubscription() *subscription {
+	return &subscription{responses: make(chan Message, subscriptionSize+1), done: make(chan struct{})}
+}
+
+// deliver queues msg without blocking, returning false if the subscriber has fallen
+// behind and msg doesn't fit. Errors always fit, since only one is ever delivered.
+func (sub *subscription) deliver(msg Message) bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	select {
+	case <-sub.done:
+		return true
+	default:
+	}
+	if msg.Err == nil && len(sub.responses) >= subscriptionSize {
+		return false
+	}
+	sub.responses <- msg
+	return true
+}
+
+func (sub *subscription) close() {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+		sub.lock.Lock()
+		close(sub.responses)
+		sub.lock.Unlock()
+	})
+}
+
+// ----------------------------------------------------------------------------
+// Subscribe
+// ----------------------------------------------------------------------------
+
+// Subscribe sends req, which must be a BixRequest, and returns a channel yielding
+// every response correlated to it by mid. The channel is closed after a response
+// without the messages.ParamMore flag, after an error, or once the subscription is
+// cancelled, either by calling the returned cancel function or through ctx.
+// Cancelling an active subscription sends an UnsubscribeRequest to the server.
+func (self *Client) Subscribe(ctx context.Context, req interface{}) (<-chan Message, func()) {
+	sub := newSubscription()
+
+	// Serialize request, and read back the fields used to correlate responses
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	if err := binaryxml.Encode(req, writer); err != nil {
+		sub.deliver(Message{Err: err})
+		sub.close()
+		return sub.responses, func() {}
+	}
+	writer.Flush()
+	binaryXML := buffer.Bytes()
+	if err := binaryxml.Decode(binaryXML, &sub.header); err != nil {
+		sub.deliver(Message{Err: err})
+		sub.close()
+		return sub.responses, func() {}
+	}
+
+	// Register subscription before sending, so that no response can be missed
+	self.lock.Lock()
+	self.startReading()
+	if self.readErr != nil {
+		err := self.readErr
+		self.lock.Unlock()
+		sub.deliver(Message{Err: err})
+		sub.close()
+		return sub.responses, func() {}
+	}
+	if existing, exists := self.subscriptions[sub.header.MID]; exists && !existing.cancelled {
+		self.lock.Unlock()
+		sub.deliver(Message{Err: errors.New("A subscription with the same mid is already active")})
+		sub.close()
+		return sub.responses, func() {}
+	}
+	if _, exists := self.calls[sub.header.MID]; exists {
+		self.lock.Unlock()
+		sub.deliver(Message{Err: errors.New("A call with the same mid is already pending")})
+		sub.close()
+		return sub.responses, func() {}
+	}
+	self.subscriptions[sub.header.MID] = sub
+	self.lock.Unlock()
+
+	if err := self.SendRaw(0, binaryXML); err != nil {
+		self.endSubscription(sub)
+		sub.deliver(Message{Err: err})
+		sub.close()
+		return sub.responses, func() {}
+	}
+
+	cancel := func() {
+		self.cancelSubscription(sub)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-sub.done:
+		}
+	}()
+	return sub.responses, cancel
+}
+
+func (self *Client) cancelSubscription(sub *subscription) {
+	active := self.markCancelled(sub)
+	sub.close()
+	if active {
+		self.unsubscribe(sub)
+	}
+}
+
+// markCancelled keeps discarding responses to the mid of an active subscription until
+// the server sends a final one, or for cancelledSubscriptionTimeout at most. Returns
+// whether the subscription was active.
+func (self *Client) markCancelled(sub *subscription) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.subscriptions[sub.header.MID] != sub || sub.cancelled {
+		return false
+	}
+	sub.cancelled = true
+	time.AfterFunc(cancelledSubscriptionTimeout, func() {
+		self.endSubscription(sub)
+	})
+	return true
+}
+
+func (self *Client) unsubscribe(sub *subscription) {
+	unsubscribe := binaryxml.BixRequest{ToNamespace: sub.header.ToNamespace, Request: UnsubscribeRequest, MOID: sub.header.MOID, MID: sub.header.MID}
+	if err := self.Send(0, unsubscribe); err != nil {
+		logger.Warnf("Failed sending %s for %s::%s: %v", UnsubscribeRequest, sub.header.ToNamespace, sub.header.Request, err)
+	}
+}
+
+func (self *Client) endSubscription(sub *subscription) {
+	self.lock.Lock()
+	if self.subscriptions[sub.header.MID] == sub {
+		delete(self.subscriptions, sub.header.MID)
+	}
+	self.lock.Unlock()
+}
+
+// ----------------------------------------------------------------------------
+// Background reader
+// ----------------------------------------------------------------------------
+
+// startReading hands the connection's reader over to a background goroutine that
+// dispatches responses to calls, handshakes and subscriptions. Must be called with
+// self.lock held.
+func (self *Client) startReading() {
+	if self.inbox != nil {
+		return
+	}
+	self.inbox = make(chan Message, inboxSize)
+	if self.subscriptions == nil {
+		self.subscriptions = make(map[uint64]*subscription)
+	}
+	if self.calls == nil {
+		self.calls = make(map[uint64]chan Message)
+	}
+	stopped := make(chan struct{})
+	go self.readLoop(self.messageReader(), self.inbox, stopped)
+	if self.KeepaliveInterval > 0 {
+		go self.keepalive(stopped)
+	}
+}
+
+// readLoop reads messages until the connection fails, and then closes the client.
+func (self *Client) readLoop(reader *messages.Reader, inbox chan Message, stopped chan struct{}) {
+	defer close(stopped)
+
+	// Let foreground receives still reading finish. Later ones find the inbox.
+	self.readLock.Lock()
+	self.readLock.Unlock()
+	for {
+		atomic.StoreInt64(&self.waitingSince, time.Now().UnixNano())
+		pooled, err := reader.Next()
+		atomic.StoreInt64(&self.waitingSince, 0)
+		if err != nil {
+			closed := self.closed()
+			self.lock.Lock()
+			if self.timedOut {
+				err = ErrKeepaliveTimeout
+			} else if closed {
+				err = ErrClosed
+			}
+			self.lock.Unlock()
+			self.stopReading(inbox, err)
+			return
+		}
+		if self.control(pooled) {
+			continue
+		}
+		param := pooled.Param
+		inboxMsg := Message{Param: param, BinaryXML: pooled.BinaryXML, pooled: pooled}
+		if param == messages.ControlHello {
+			if self.answerHandshake(inboxMsg) {
+				continue
+			}
+
+			// A server rejecting the client outside of a handshake closes the
+			// connection, so everything waiting fails with its reason
+			err := helloError(pooled)
+			pooled.Release()
+			self.stopReading(inbox, err)
+			return
+		}
+
+		// Correlate by mid without decoding the whole message
+		name, mid, err := binaryxml.EnvelopeMID(pooled.BinaryXML)
+		if err != nil {
+			self.queue(inbox, inboxMsg)
+			continue
+		}
+		final := param&messages.ParamMore == 0 || name == "BixError"
+
+		self.lock.Lock()
+		if response, called := self.calls[mid]; called {
+			delete(self.calls, mid)
+			self.lock.Unlock()
+			response <- inboxMsg
+			continue
+		}
+		sub, correlated := self.subscriptions[mid]
+		if correlated && final {
+			delete(self.subscriptions, mid)
+		}
+		cancelled := correlated && sub.cancelled
+		self.lock.Unlock()
+		if !correlated {
+			self.queue(inbox, inboxMsg)
+			continue
+		}
+
+		// Subscribers keep their messages, so they get a copy
+		var binaryXML []byte
+		if !cancelled {
+			binaryXML = append(binaryXML, pooled.BinaryXML...)
+		}
+		pooled.Release()
+		msg := Message{Param: param, BinaryXML: binaryXML}
+		switch {
+		case cancelled:
+			// Response to a cancelled subscription
+		case name == "BixError":
+			var bixError binaryxml.BixError
+			err := binaryxml.Decode(binaryXML, &bixError)
+			if err == nil {
+				err = newRemoteError(&bixError)
+			}
+			sub.deliver(Message{Param: param, BinaryXML: binaryXML, Err: err})
+			sub.close()
+		default:
+			if !sub.deliver(msg) {
+				self.overflow(sub)
+			} else if final {
+				sub.close()
+			}
+		}
+	}
+}
+
+// stopReading closes the client once reading failed with err, failing everything
+// waiting for a message with it.
+func (self *Client) stopReading(inbox chan Message, err error) {
+	self.Close()
+	self.lock.Lock()
+	self.readErr = err
+	subscriptions := self.subscriptions
+	self.subscriptions = make(map[uint64]*subscription)
+	waiters := make([]chan Message, 0, len(self.calls)+1)
+	for _, response := range self.calls {
+		waiters = append(waiters, response)
+	}
+	if self.hello != nil {
+		waiters = append(waiters, self.hello)
+	}
+	self.lock.Unlock()
+	for _, sub := range subscriptions {
+		sub.deliver(Message{Err: err})
+		sub.close()
+	}
+	for _, waiter := range waiters {
+		select {
+		case waiter <- Message{Err: err}:
+		default:
+		}
+	}
+	select {
+	case inbox <- Message{Err: err}:
+	default:
+	}
+	close(inbox)
+}
+
+// answerHandshake hands a hello to the pending handshake, returning false if there
+// is none.
+func (self *Client) answerHandshake(msg Message) bool {
+	self.lock.Lock()
+	hello := self.hello
+	self.hello = nil
+	self.lock.Unlock()
+	if hello == nil {
+		return false
+	}
+	hello <- msg
+	return true
+}
+
+// overflow ends a subscription that fell behind, unsubscribing in the background
+// rather than holding up the reader.
+func (self *Client) overflow(sub *subscription) {
+	logger.Warnf("Ending subscription to %s::%s, whose responses were not consumed in time", sub.header.ToNamespace, sub.header.Request)
+	if self.markCancelled(sub) {
+		go self.unsubscribe(sub)
+	}
+	sub.deliver(Message{Err: ErrSubscriptionOverflow})
+	sub.close()
+}
+
+// queue a message for ReceiveMessage without blocking. Messages that don't fit, as
+// inboxSize messages are already waiting to be received, are dropped.
+func (self *Client) queue(inbox chan Message, msg Message) {
+	select {
+	case inbox <- msg:
+	default:
+		logger.Warnf("Dropping message from %s, as %d messages are waiting to be received", self.Conn.RemoteAddr(), inboxSize)
+		msg.pooled.Release()
+	}
+}
@@ -0,0 +1,288 @@
+package client_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/docktermj/go-logger/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type subscribeRequest struct {
+	XMLName     struct{} `xml:"BixRequest"`
+	ToNamespace string   `xml:"toNamespace"`
+	Request     string   `xml:"request"`
+	MOID        uint64   `xml:"moid"`
+	MID         uint64   `xml:"mid"`
+}
+
+type subscribeResponse struct {
+	XMLName       struct{} `xml:"BixResponse"`
+	FromNamespace string   `xml:"fromNamespace"`
+	MID           uint64   `xml:"mid"`
+	Value         uint32   `xml:"value"`
+}
+
+func writeSubscribeResponse(writer *bufio.Writer, param uint8, res subscribeResponse) error {
+	var buffer bytes.Buffer
+	bufferWriter := bufio.NewWriter(&buffer)
+	if err := binaryxml.Encode(res, bufferWriter); err != nil {
+		return err
+	}
+	bufferWriter.Flush()
+	if err := messages.WriteMessage(writer, param, buffer.Bytes()); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func TestSubscribe(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+
+	// Create a server
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	unsubscribed := make(chan subscribeRequest, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+
+		// Read subscribe request
+		var param uint8
+		var binaryXML []byte
+		if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+			return
+		}
+
+		// Stream responses, interleaved with one for an unrelated request
+		more := messages.ParamResponse | messages.ParamMore
+		writeSubscribeResponse(writer, more, subscribeResponse{FromNamespace: "foo", MID: 7, Value: 1})
+		writeSubscribeResponse(writer, messages.ParamResponse, subscribeResponse{FromNamespace: "foo", MID: 8, Value: 100})
+		writeSubscribeResponse(writer, more, subscribeResponse{FromNamespace: "foo", MID: 7, Value: 2})
+
+		// Expect an unsubscribe request
+		if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+			return
+		}
+		var req subscribeRequest
+		if err := binaryxml.Decode(binaryXML, &req); err == nil {
+			unsubscribed <- req
+		}
+	}()
+
+	// Create a client
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+
+	// Subscribe and consume two responses
+	responses, cancel := bixClient.Subscribe(context.Background(), subscribeRequest{ToNamespace: "foo", Request: "Subscribe", MOID: 3, MID: 7})
+	for _, expected := range []uint32{1, 2} {
+		msg := <-responses
+		assert.NoError(msg.Err)
+		assert.Equal(messages.ParamResponse|messages.ParamMore, msg.Param)
+		var res subscribeResponse
+		assert.NoError(binaryxml.Decode(msg.BinaryXML, &res))
+		assert.Equal(expected, res.Value)
+	}
+
+	// Uncorrelated response remains available to Receive
+	var param uint8
+	var res subscribeResponse
+	assert.NoError(bixClient.Receive(&param, &res))
+	assert.Equal(uint32(100), res.Value)
+
+	// Cancel subscription
+	cancel()
+	_, ok := <-responses
+	assert.False(ok)
+	select {
+	case req := <-unsubscribed:
+		assert.Equal("foo", req.ToNamespace)
+		assert.Equal(client.UnsubscribeRequest, req.Request)
+		assert.Equal(uint64(3), req.MOID)
+		assert.Equal(uint64(7), req.MID)
+	case <-time.After(time.Second):
+		assert.Fail("Expected an unsubscribe request")
+	}
+}
+
+func TestSubscribeEndMarker(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+
+	// Create a server
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+
+		var param uint8
+		var binaryXML []byte
+		if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+			return
+		}
+		writeSubscribeResponse(writer, messages.ParamResponse|messages.ParamMore, subscribeResponse{MID: 7, Value: 1})
+		writeSubscribeResponse(writer, messages.ParamResponse, subscribeResponse{MID: 7, Value: 2})
+		time.Sleep(200 * time.Millisecond)
+	}()
+
+	client, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	responses, _ := client.Subscribe(ctx, subscribeRequest{ToNamespace: "foo", Request: "Subscribe", MID: 7})
+	var values []uint32
+	for msg := range responses {
+		assert.NoError(msg.Err)
+		var res subscribeResponse
+		assert.NoError(binaryxml.Decode(msg.BinaryXML, &res))
+		values = append(values, res.Value)
+	}
+	assert.Equal([]uint32{1, 2}, values)
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+
+	// Create a server streaming more responses than a subscription buffers
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+
+		var param uint8
+		var binaryXML []byte
+		if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+			return
+		}
+		for value := uint32(1); value <= 20; value++ {
+			writeSubscribeResponse(writer, messages.ParamResponse|messages.ParamMore, subscribeResponse{MID: 7, Value: value})
+		}
+		writeSubscribeResponse(writer, messages.ParamResponse, subscribeResponse{MID: 8, Value: 100})
+		if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+			return
+		}
+		var req subscribeRequest
+		if err := binaryxml.Decode(binaryXML, &req); err == nil && req.Request == client.UnsubscribeRequest {
+			close(unsubscribed)
+		}
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Close()
+
+	// A subscriber not consuming its responses doesn't hold up other receives
+	responses, cancel := bixClient.Subscribe(context.Background(), subscribeRequest{ToNamespace: "foo", Request: "Subscribe", MID: 7})
+	defer cancel()
+	var param uint8
+	var res subscribeResponse
+	assert.NoError(bixClient.Receive(&param, &res))
+	assert.Equal(uint32(100), res.Value)
+
+	// The subscription ends with an error after the responses it buffered
+	var values []uint32
+	var lastErr error
+	for msg := range responses {
+		if msg.Err != nil {
+			lastErr = msg.Err
+			continue
+		}
+		var res subscribeResponse
+		assert.NoError(binaryxml.Decode(msg.BinaryXML, &res))
+		values = append(values, res.Value)
+	}
+	assert.Equal(16, len(values))
+	assert.Equal(client.ErrSubscriptionOverflow, lastErr)
+	assert.True(closedWithin(unsubscribed, time.Second))
+}
+
+func TestSubscribeReusesCancelledMID(t *testing.T) {
+	logger.SetLevel(logger.LevelDebug)
+	assert := assert.New(t)
+
+	// Create a server answering subscriptions with a response, but never a final one
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		writer := bufio.NewWriter(conn)
+		value := uint32(0)
+		for {
+			var param uint8
+			var binaryXML []byte
+			if err := messages.ReadMessage(reader, &param, &binaryXML); err != nil {
+				return
+			}
+			var req subscribeRequest
+			if err := binaryxml.Decode(binaryXML, &req); err != nil || req.Request == client.UnsubscribeRequest {
+				continue
+			}
+			value++
+			writeSubscribeResponse(writer, messages.ParamResponse|messages.ParamMore, subscribeResponse{MID: req.MID, Value: value})
+		}
+	}()
+
+	bixClient, err := client.Connect("127.0.0.1", port)
+	assert.NoError(err)
+	defer bixClient.Close()
+
+	responses, cancel := bixClient.Subscribe(context.Background(), subscribeRequest{ToNamespace: "foo", Request: "Subscribe", MID: 7})
+	msg := <-responses
+	assert.NoError(msg.Err)
+	cancel()
+
+	// The mid of the cancelled subscription is free again
+	responses, cancel = bixClient.Subscribe(context.Background(), subscribeRequest{ToNamespace: "foo", Request: "Subscribe", MID: 7})
+	defer cancel()
+	msg = <-responses
+	assert.NoError(msg.Err)
+	var res subscribeResponse
+	assert.NoError(binaryxml.Decode(msg.BinaryXML, &res))
+	assert.Equal(uint32(2), res.Value)
+}
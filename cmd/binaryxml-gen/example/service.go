@@ -0,0 +1,21 @@
+// Package example holds a service and the code binaryxml-gen generates for it,
+// checked in so that building the repository type-checks generated code. The tests
+// of binaryxml-gen check that it is what the generator writes.
+package example
+
+//go:generate binaryxml-gen -type SubscriptionManager
+
+import "context"
+
+type SubscribeReq struct {
+	Namespace string `xml:"namespace"`
+}
+
+type SubscribeRes struct {
+	ID uint64 `xml:"id"`
+}
+
+type SubscriptionManager interface {
+	Subscribe(ctx context.Context, req *SubscribeReq) (*SubscribeRes, error)
+	Unsubscribe(context.Context, *SubscribeRes) (*SubscribeRes, error)
+}
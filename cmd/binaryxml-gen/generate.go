@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// ----------------------------------------------------------------------------
+// Service description
+// ----------------------------------------------------------------------------
+
+type service struct {
+	Package   string
+	Interface string
+	Namespace string
+	Methods   []method
+}
+
+type method struct {
+	Name     string
+	Request  string
+	Response string
+}
+
+// ----------------------------------------------------------------------------
+// Parsing
+// ----------------------------------------------------------------------------
+
+// parseService finds the named interface among the non-test Go files of dir.
+func parseService(dir string, interfaceName string, skip string) (*service, error) {
+	fset := token.NewFileSet()
+	filter := func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go") && info.Name() != skip
+	}
+	packages, err := parser.ParseDir(fset, dir, filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range packages {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				genDecl, ok := decl.(*ast.GenDecl)
+				if !ok || genDecl.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range genDecl.Specs {
+					typeSpec := spec.(*ast.TypeSpec)
+					if typeSpec.Name.Name != interfaceName {
+						continue
+					}
+					interfaceType, ok := typeSpec.Type.(*ast.InterfaceType)
+					if !ok {
+						return nil, fmt.Errorf("%s is not an interface", interfaceName)
+					}
+					return newService(pkg.Name, interfaceName, interfaceType)
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("Interface %s not found in %s", interfaceName, dir)
+}
+
+func newService(packageName string, interfaceName string, interfaceType *ast.InterfaceType) (*service, error) {
+	svc := service{Package: packageName, Interface: interfaceName, Namespace: interfaceName}
+	for _, field := range interfaceType.Methods.List {
+		funcType, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) != 1 {
+			return nil, fmt.Errorf("%s: embedded interfaces are not supported", interfaceName)
+		}
+		name := field.Names[0].Name
+		params := flattenFields(funcType.Params)
+		results := flattenFields(funcType.Results)
+		if len(params) != 2 || len(results) != 2 {
+			return nil, fmt.Errorf("%s.%s: expected signature func(context.Context, *Request) (*Response, error)", interfaceName, name)
+		}
+		if !isContext(params[0]) {
+			return nil, fmt.Errorf("%s.%s: first parameter must be a context.Context", interfaceName, name)
+		}
+		request, ok := pointerToLocalType(params[1])
+		if !ok {
+			return nil, fmt.Errorf("%s.%s: second parameter must be a pointer to a type of package %s", interfaceName, name, packageName)
+		}
+		response, ok := pointerToLocalType(results[0])
+		if !ok {
+			return nil, fmt.Errorf("%s.%s: first result must be a pointer to a type of package %s", interfaceName, name, packageName)
+		}
+		if ident, ok := results[1].(*ast.Ident); !ok || ident.Name != "error" {
+			return nil, fmt.Errorf("%s.%s: second result must be an error", interfaceName, name)
+		}
+		svc.Methods = append(svc.Methods, method{Name: name, Request: request, Response: response})
+	}
+	return &svc, nil
+}
+
+func flattenFields(fields *ast.FieldList) []ast.Expr {
+	var exprs []ast.Expr
+	if fields == nil {
+		return exprs
+	}
+	for _, field := range fields.List {
+		count := len(field.Names)
+		if count == 0 {
+			count = 1
+		}
+		for i := 0; i < count; i++ {
+			exprs = append(exprs, field.Type)
+		}
+	}
+	return exprs
+}
+
+func isContext(expr ast.Expr) bool {
+	selector, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := selector.X.(*ast.Ident)
+	return ok && pkg.Name == "context" && selector.Sel.Name == "Context"
+}
+
+func pointerToLocalType(expr ast.Expr) (string, bool) {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return "", false
+	}
+	ident, ok := star.X.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	return ident.Name, true
+}
+
+// ----------------------------------------------------------------------------
+// Code generation
+// ----------------------------------------------------------------------------
+
+func generate(svc *service) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := serviceTemplate.Execute(&buffer, svc); err != nil {
+		return nil, err
+	}
+	source, err := format.Source(buffer.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("Generated invalid code for %s: %v", svc.Interface, err)
+	}
+	return source, nil
+}
+
+var serviceTemplate = template.Must(template.New("service").Parse(`// Code generated by binaryxml-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/router"
+)
+{{$svc := .}}
+// ----------------------------------------------------------------------------
+// Client stub
+// ----------------------------------------------------------------------------
+
+// {{.Interface}}Client calls {{.Interface}} methods on a remote router.
+type {{.Interface}}Client struct {
+	Client *client.Client
+	MOID   uint64
+}
+
+func New{{.Interface}}Client(c *client.Client) *{{.Interface}}Client {
+	return &{{.Interface}}Client{Client: c}
+}
+{{range .Methods}}
+func (stub *{{$svc.Interface}}Client) {{.Name}}(ctx context.Context, req *{{.Request}}) (*{{.Response}}, error) {
+	envelope := binaryxml.BixRequest{ToNamespace: "{{$svc.Namespace}}", Request: "{{.Name}}", MOID: stub.MOID, MID: stub.Client.NextMID(), Data: req}
+	res := &{{.Response}}{}
+	if err := stub.Client.Call(ctx, envelope, &binaryxml.BixResponse{Data: res}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+{{end}}
+// ----------------------------------------------------------------------------
+// Router registration
+// ----------------------------------------------------------------------------
+
+// Register{{.Interface}} routes {{.Namespace}} requests to impl.
+func Register{{.Interface}}(r router.Router, impl {{.Interface}}) {
+{{- range .Methods}}
+	r.AddTyped("/BixRequest[toNamespace='{{$svc.Namespace}}'][request='{{.Name}}']", func(ctx *router.Context, req *{{.Request}}) (*{{.Response}}, error) {
+		return impl.{{.Name}}(ctx.Context(), req)
+	})
+{{- end}}
+}
+`))
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/cmd/binaryxml-gen/example"
+	"github.com/BixData/binaryxml/router"
+	"github.com/stretchr/testify/assert"
+)
+
+const subscriptionManagerSource = `package subscriptions
+
+import "context"
+
+type SubscribeReq struct {
+	Namespace string ` + "`xml:\"namespace\"`" + `
+}
+
+type SubscribeRes struct {
+	ID uint64 ` + "`xml:\"id\"`" + `
+}
+
+type SubscriptionManager interface {
+	Subscribe(ctx context.Context, req *SubscribeReq) (*SubscribeRes, error)
+	Unsubscribe(context.Context, *SubscribeRes) (*SubscribeRes, error)
+}
+
+type Broken interface {
+	Subscribe(req *SubscribeReq) (*SubscribeRes, error)
+}
+`
+
+func writeSource(t *testing.T, source string) string {
+	dir, err := ioutil.TempDir("", "binaryxml-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "service.go"), []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestGenerate(t *testing.T) {
+	assert := assert.New(t)
+	dir := writeSource(t, subscriptionManagerSource)
+	defer os.RemoveAll(dir)
+
+	svc, err := parseService(dir, "SubscriptionManager", "subscriptionmanager_bix.go")
+	assert.NoError(err)
+	assert.Equal("subscriptions", svc.Package)
+	assert.Equal([]method{
+		{Name: "Subscribe", Request: "SubscribeReq", Response: "SubscribeRes"},
+		{Name: "Unsubscribe", Request: "SubscribeRes", Response: "SubscribeRes"},
+	}, svc.Methods)
+
+	source, err := generate(svc)
+	assert.NoError(err)
+	_, err = parser.ParseFile(token.NewFileSet(), "subscriptionmanager_bix.go", source, 0)
+	assert.NoError(err)
+	assert.Contains(string(source), "/BixRequest[toNamespace='SubscriptionManager'][request='Subscribe']")
+	assert.Contains(string(source), "/BixRequest[toNamespace='SubscriptionManager'][request='Unsubscribe']")
+	assert.Contains(string(source), "func (stub *SubscriptionManagerClient) Subscribe(ctx context.Context, req *SubscribeReq) (*SubscribeRes, error)")
+	assert.Contains(string(source), "func RegisterSubscriptionManager(r router.Router, impl SubscriptionManager)")
+	assert.Contains(string(source), "func(ctx *router.Context, req *SubscribeReq) (*SubscribeRes, error)")
+}
+
+func TestGenerateRejectsInvalidSignature(t *testing.T) {
+	assert := assert.New(t)
+	dir := writeSource(t, subscriptionManagerSource)
+	defer os.RemoveAll(dir)
+
+	_, err := parseService(dir, "Broken", "")
+	assert.Error(err)
+	_, err = parseService(dir, "Missing", "")
+	assert.Error(err)
+}
+
+// The code checked in under example, which builds with the repository, is what the
+// generator writes
+func TestGenerateExample(t *testing.T) {
+	assert := assert.New(t)
+	svc, err := parseService("example", "SubscriptionManager", "subscriptionmanager_bix.go")
+	assert.NoError(err)
+	source, err := generate(svc)
+	assert.NoError(err)
+	golden, err := ioutil.ReadFile(filepath.Join("example", "subscriptionmanager_bix.go"))
+	assert.NoError(err)
+	assert.Equal(string(golden), string(source))
+}
+
+type contextRecorder struct {
+	ctx context.Context
+}
+
+func (r *contextRecorder) Subscribe(ctx context.Context, req *example.SubscribeReq) (*example.SubscribeRes, error) {
+	r.ctx = ctx
+	return &example.SubscribeRes{ID: 1}, nil
+}
+
+func (r *contextRecorder) Unsubscribe(ctx context.Context, req *example.SubscribeRes) (*example.SubscribeRes, error) {
+	r.ctx = ctx
+	return req, nil
+}
+
+// Generated routes pass the context of requests on to handlers
+func TestGeneratedRoutesPassContext(t *testing.T) {
+	assert := assert.New(t)
+	r := router.NewRouter()
+	recorder := &contextRecorder{}
+	example.RegisterSubscriptionManager(r, recorder)
+
+	var buffer bytes.Buffer
+	writer := bufio.NewWriter(&buffer)
+	assert.NoError(binaryxml.Encode(binaryxml.BixRequest{ToNamespace: "SubscriptionManager", Request: "Subscribe", MID: 1, Data: &example.SubscribeReq{Namespace: "VirtualMachines"}}, writer))
+	writer.Flush()
+	request, err := router.NewRequest(buffer.Bytes())
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(r.Handle(router.NewContextWithContext(ctx, request)))
+	assert.Equal(ctx, recorder.ctx)
+}
@@ -0,0 +1,65 @@
+// Command binaryxml-gen generates a client stub and router registration code for
+// a Go interface whose methods have the form
+//
+//	Method(ctx context.Context, req *Request) (*Response, error)
+//
+// Each method is exposed as the BixRequest route
+// /BixRequest[toNamespace='Interface'][request='Method'], with the request and
+// response types carried in the envelope's Data element. Typically invoked with
+//
+//	//go:generate binaryxml-gen -type SubscriptionManager
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	interfaceName := flag.String("type", "", "name of the interface to generate code for (required)")
+	namespace := flag.String("namespace", "", "toNamespace to route on; defaults to the interface name")
+	output := flag.String("output", "", "output file name; defaults to <type>_bix.go")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: binaryxml-gen -type Interface [flags] [directory]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *interfaceName == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	outputName := *output
+	if outputName == "" {
+		outputName = strings.ToLower(*interfaceName) + "_bix.go"
+	}
+
+	svc, err := parseService(dir, *interfaceName, filepath.Base(outputName))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "binaryxml-gen: %v\n", err)
+		os.Exit(1)
+	}
+	if *namespace != "" {
+		svc.Namespace = *namespace
+	}
+	source, err := generate(svc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "binaryxml-gen: %v\n", err)
+		os.Exit(1)
+	}
+	if !filepath.IsAbs(outputName) {
+		outputName = filepath.Join(dir, outputName)
+	}
+	if err := ioutil.WriteFile(outputName, source, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "binaryxml-gen: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,177 @@
+// Command bxml converts and inspects binary XML files.
+//
+//	bxml to-xml [-pretty] [file]
+//	                          convert binary XML to XML; -pretty writes an
+//	                          indented document with an XML declaration
+//	bxml from-xml [file]      convert XML to binary XML
+//	bxml to-json [-types] [file]
+//	                          convert binary XML to JSON; -types writes the
+//	                          type of typed values, for lossless conversions
+//	bxml from-json [file]     convert JSON to binary XML
+//	bxml dump [file]          list the table entries and tokens of binary XML,
+//	                          with their offsets and raw bytes
+//	bxml validate [file...]   check that files are valid binary XML
+//
+// Input is read from the named files, or from stdin when there are none or a file
+// is named "-". Output is written to stdout.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/BixData/binaryxml"
+)
+
+const usage = `Usage: bxml <command> [file]
+
+Commands:
+  to-xml     convert binary XML to XML; with -pretty, writes an indented
+             document with an XML declaration
+  from-xml   convert XML to binary XML
+  to-json    convert binary XML to JSON; with -types, writes the type of typed
+             values, for lossless conversions
+  from-json  convert JSON to binary XML
+  dump       list table entries and tokens with their offsets and raw bytes
+  validate   check that files are valid binary XML; accepts several files
+
+Input is read from file, or from stdin when file is missing or "-".
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes the command line args, and returns the exit status
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("bxml "+command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pretty := flags.Bool("pretty", false, "write indented XML with a declaration")
+	types := flags.Bool("types", false, "write the type of typed values in JSON")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	files := flags.Args()
+	if command == "validate" {
+		return validate(files, stdin, stdout, stderr)
+	}
+	if len(files) > 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	name := "-"
+	if len(files) == 1 {
+		name = files[0]
+	}
+
+	var convert func(input []byte, output io.Writer) error
+	switch command {
+	case "to-xml":
+		convert = func(input []byte, output io.Writer) error {
+			if *pretty {
+				return binaryxml.WriteXML(output, input, binaryxml.XMLOptions{Indent: "  ", Declaration: true, SelfClose: true, Limits: binaryxml.DefaultDecodeLimits})
+			}
+			xml, err := binaryxml.ToXML(input)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(output, xml)
+			return err
+		}
+	case "from-xml":
+		convert = func(input []byte, output io.Writer) error {
+			binaryXML, err := binaryxml.FromXML(string(input))
+			if err != nil {
+				return err
+			}
+			_, err = output.Write(binaryXML)
+			return err
+		}
+	case "to-json":
+		convert = func(input []byte, output io.Writer) error {
+			json, err := binaryxml.ToJSONWithOptions(input, binaryxml.JSONOptions{PreserveTypes: *types, Limits: binaryxml.DefaultDecodeLimits})
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(output, json)
+			return err
+		}
+	case "from-json":
+		convert = func(input []byte, output io.Writer) error {
+			binaryXML, err := binaryxml.FromJSON(string(input))
+			if err != nil {
+				return err
+			}
+			_, err = output.Write(binaryXML)
+			return err
+		}
+	case "dump":
+		convert = binaryxml.Dump
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "bxml: unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+
+	input, err := readInput(name, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "bxml: %v\n", err)
+		return 1
+	}
+
+	// Dumps are most useful up to their error, so they are written as they go, while
+	// other conversions only write complete output
+	var buffer bytes.Buffer
+	output := io.Writer(&buffer)
+	if command == "dump" {
+		output = stdout
+	}
+	if err := convert(input, output); err != nil {
+		fmt.Fprintf(stderr, "bxml: %s: %v\n", name, err)
+		return 1
+	}
+	if _, err := buffer.WriteTo(stdout); err != nil {
+		fmt.Fprintf(stderr, "bxml: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// validate checks every file, reporting each of them, and fails if any is invalid
+func validate(files []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	status := 0
+	for _, name := range files {
+		input, err := readInput(name, stdin)
+		if err == nil {
+			err = binaryxml.Validate(input)
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "%s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: ok\n", name)
+	}
+	return status
+}
+
+func readInput(name string, stdin io.Reader) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(name)
+}
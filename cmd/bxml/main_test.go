@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+const fixture1 = "../../testdata/test-systemlib-1.binaryxml"
+
+func TestRunToXMLAndFromXML(t *testing.T) {
+	assert := assert.New(t)
+	var stdout, stderr bytes.Buffer
+	assert.Equal(0, run([]string{"to-xml", fixture1}, nil, &stdout, &stderr))
+	assert.Empty(stderr.String())
+	xml := stdout.String()
+	assert.True(strings.HasPrefix(xml, "<BixRequest>"))
+
+	// Read from stdin
+	stdout.Reset()
+	assert.Equal(0, run([]string{"from-xml", "-"}, strings.NewReader(xml), &stdout, &stderr))
+	assert.Empty(stderr.String())
+	roundTripped, err := binaryxml.ToXML(stdout.Bytes())
+	assert.NoError(err)
+	assert.Equal(strings.TrimSuffix(xml, "\n"), roundTripped)
+}
+
+func TestRunToXMLPretty(t *testing.T) {
+	assert := assert.New(t)
+	golden, err := ioutil.ReadFile("../../testdata/test-systemlib-1.xml")
+	assert.NoError(err)
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(0, run([]string{"to-xml", "-pretty", fixture1}, nil, &stdout, &stderr))
+	assert.Equal(string(golden), stdout.String())
+}
+
+func TestRunToJSON(t *testing.T) {
+	assert := assert.New(t)
+	var stdout, stderr bytes.Buffer
+	assert.Equal(0, run([]string{"to-json", fixture1}, nil, &stdout, &stderr))
+	assert.Equal(`{"BixRequest":{"toNamespace":"VirtualMachines","request":"Testing","moid":"6","mid":"1"}}`+"\n", stdout.String())
+}
+
+func TestRunToJSONAndFromJSON(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := ioutil.ReadFile(fixture1)
+	assert.NoError(err)
+	xml, err := binaryxml.ToXML(binaryXML)
+	assert.NoError(err)
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(0, run([]string{"to-json", "-types", fixture1}, nil, &stdout, &stderr))
+	json := stdout.String()
+	stdout.Reset()
+	assert.Equal(0, run([]string{"from-json"}, strings.NewReader(json), &stdout, &stderr))
+	assert.Empty(stderr.String())
+	roundTripped, err := binaryxml.ToXML(stdout.Bytes())
+	assert.NoError(err)
+	assert.Equal(xml, roundTripped)
+}
+
+func TestRunDump(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := ioutil.ReadFile(fixture1)
+	assert.NoError(err)
+
+	// Dumps of malformed input are written up to the error
+	var stdout, stderr bytes.Buffer
+	assert.Equal(1, run([]string{"dump"}, bytes.NewReader(binaryXML[:0x38]), &stdout, &stderr))
+	assert.Contains(stdout.String(), "node 5 BixRequest")
+	assert.Contains(stdout.String(), "error: ")
+	assert.Contains(stderr.String(), "bxml: -: ")
+}
+
+func TestRunValidate(t *testing.T) {
+	assert := assert.New(t)
+	var stdout, stderr bytes.Buffer
+	assert.Equal(1, run([]string{"validate", fixture1, "-"}, strings.NewReader("junk"), &stdout, &stderr))
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	assert.Equal(2, len(lines))
+	assert.Equal(fixture1+": ok", lines[0])
+	assert.True(strings.HasPrefix(lines[1], "-: "))
+}
+
+func TestRunUsage(t *testing.T) {
+	assert := assert.New(t)
+	var stdout, stderr bytes.Buffer
+	assert.Equal(2, run(nil, nil, &stdout, &stderr))
+	assert.Equal(2, run([]string{"convert"}, nil, &stdout, &stderr))
+	assert.Equal(2, run([]string{"to-xml", "a", "b"}, nil, &stdout, &stderr))
+	assert.Equal(2, run([]string{"to-xml", "-unknown"}, nil, &stdout, &stderr))
+	assert.Contains(stderr.String(), `unknown command "convert"`)
+	assert.Equal(0, run([]string{"help"}, nil, &stdout, &stderr))
+	assert.Equal(usage, stdout.String())
+}
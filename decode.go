@@ -2,12 +2,101 @@ package binaryxml
 
 import (
 	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
 )
 
+// Decode decodes a binary XML document into v, as encoding/xml unmarshals its XML,
+// within DefaultDecodeLimits.
 func Decode(binaryXML []byte, v interface{}) error {
-	xmlString, err := ToXML(binaryXML)
+	return DecodeWithLimits(binaryXML, v, DefaultDecodeLimits)
+}
+
+// DecodeWithLimits decodes a binary XML document into v like Decode, within limits.
+func DecodeWithLimits(binaryXML []byte, v interface{}, limits DecodeLimits) error {
+	// Floats are written with as many digits as they need to decode to the same value
+	xmlString, err := ToXMLWithOptions(binaryXML, XMLOptions{Limits: limits, FloatPrecision: -1})
 	if err != nil {
 		return err
 	}
 	return xml.Unmarshal([]byte(xmlString), v)
 }
+
+// RootElementName returns the name of the root element of a binary XML document,
+// reading no further, so that the type to decode a document into can be chosen
+// first.
+func RootElementName(binaryXML []byte) (string, error) {
+	s := newScanner(binaryXML)
+	if err := s.readTable(); err != nil {
+		return "", err
+	}
+	t, err := s.next()
+	return t.Name, err
+}
+
+// EnvelopeMID returns the name of the root element of a binary XML document and the
+// value of its mid child element, or 0 when it has none. The document is scanned up
+// to the mid rather than decoded, so that messages can be correlated by mid before
+// choosing what to decode them into.
+func EnvelopeMID(binaryXML []byte) (string, uint64, error) {
+	s := newScanner(binaryXML)
+	if err := s.readTable(); err != nil {
+		return "", 0, err
+	}
+	root, err := s.next()
+	if err != nil {
+		return "", 0, err
+	}
+	for {
+		t, err := s.next()
+		if err == io.EOF {
+			return root.Name, 0, nil
+		}
+		if err != nil {
+			return root.Name, 0, err
+		}
+		if t.Depth == 0 {
+			// Root element closed
+			return root.Name, 0, nil
+		}
+		if t.Depth != 1 || t.Type == endtagtype || t.Name != "mid" {
+			continue
+		}
+		mid, ok := uintValue(t.Value)
+		if !ok {
+			return root.Name, 0, s.malformed(t.Offset, "mid is not an unsigned integer")
+		}
+		return root.Name, mid, nil
+	}
+}
+
+// uintValue converts the value of a token to an unsigned integer, as Decode would.
+func uintValue(value interface{}) (uint64, bool) {
+	switch v := value.(type) {
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case int8:
+		return uint64(v), v >= 0
+	case int16:
+		return uint64(v), v >= 0
+	case int32:
+		return uint64(v), v >= 0
+	case int64:
+		return uint64(v), v >= 0
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return 0, true
+		}
+		u, err := strconv.ParseUint(v, 10, 64)
+		return u, err == nil
+	}
+	return 0, false
+}
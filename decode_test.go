@@ -1,8 +1,11 @@
 package binaryxml_test
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/BixData/binaryxml"
@@ -129,3 +132,53 @@ func TestDecodeFixture5(t *testing.T) {
 	assert.Equal(float32(3.14), fixture5.Float32_Pi)
 	assert.Equal(float32(-3.14), fixture5.Float32_NegativePi)
 }
+
+func TestRootElementName(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := ioutil.ReadFile("testdata/test-systemlib-1.binaryxml")
+	assert.NoError(err)
+	xml, err := binaryxml.ToXML(binaryXML)
+	assert.NoError(err)
+	name, err := binaryxml.RootElementName(binaryXML)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(xml, "<"+name+">"), xml)
+
+	// Documents without elements have no root
+	_, err = binaryxml.RootElementName([]byte{0x7c, 0x00, 0x00, 0x7d, 0x7e, 0x7f})
+	assert.EqualError(err, "Content is not valid binary XML; missing root element at offset 5")
+}
+
+func TestEnvelopeMID(t *testing.T) {
+	assert := assert.New(t)
+	type inner struct {
+		MID uint64 `xml:"mid"`
+	}
+	type envelope struct {
+		XMLName struct{} `xml:"BixResponse"`
+		Data    inner    `xml:"Data"`
+		MID     uint64   `xml:"mid"`
+	}
+	encode := func(v interface{}) []byte {
+		var buffer bytes.Buffer
+		writer := bufio.NewWriter(&buffer)
+		assert.NoError(binaryxml.Encode(v, writer))
+		writer.Flush()
+		return buffer.Bytes()
+	}
+
+	// The mid of nested elements is ignored
+	name, mid, err := binaryxml.EnvelopeMID(encode(envelope{Data: inner{MID: 7}, MID: 42}))
+	assert.NoError(err)
+	assert.Equal("BixResponse", name)
+	assert.Equal(uint64(42), mid)
+
+	// Documents without a mid have mid 0
+	name, mid, err = binaryxml.EnvelopeMID(encode(binaryxml.BixError{Error: "failed"}))
+	assert.NoError(err)
+	assert.Equal("BixError", name)
+	assert.Equal(uint64(0), mid)
+
+	// Documents without elements have no root
+	_, _, err = binaryxml.EnvelopeMID([]byte{0x7c, 0x00, 0x00, 0x7d, 0x7e, 0x7f})
+	assert.EqualError(err, "Content is not valid binary XML; missing root element at offset 5")
+}
@@ -57,6 +57,11 @@ func generateElementNameDictionaryForValue(value reflect.Value, table *ordered_m
 
 		addIfNeeded(fieldInfo.name, table)
 
+		// Drill into interfaces and pointers
+		for (fieldValue.Kind() == reflect.Interface || fieldValue.Kind() == reflect.Ptr) && !fieldValue.IsNil() {
+			fieldValue = fieldValue.Elem()
+		}
+
 		// Drill into nested structs
 		if fieldValue.Kind() == reflect.Struct {
 			generateElementNameDictionaryForValue(fieldValue, table)
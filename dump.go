@@ -0,0 +1,122 @@
+package binaryxml
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Raw bytes shown on a line of a dump
+const dumpBytes = 8
+
+// Dump writes an annotated listing of a binary XML document to w, to debug malformed
+// input. Every table entry and serial token is listed with its offset and raw bytes,
+// followed by the nesting depth, type tag name, element id and name, and decoded
+// value of tokens:
+//
+//	0000002d  01 00 05                  0  node 5 BixRequest
+//	00000030  0b 00 02 56 69 72 74 ..   1    str 2 toNamespace "VirtualMachines"
+//	00000043  0d                        1    endtag toNamespace
+//
+// Errors are listed where they occur. Listing continues past unknown keys and type
+// tags, misplaced end tags and missing markers, to show where the document diverges
+// from what was expected, and stops at truncated values. Bytes following the serial
+// end marker are listed, but not considered an error. The first error is returned.
+func Dump(data []byte, w io.Writer) error {
+	s := newScanner(data)
+	d := dumper{writer: w, data: data, scanner: s}
+	s.trace = func(offset int, format string, args ...interface{}) {
+		d.line(offset, -1, format, args...)
+	}
+	s.recover = func(offset int, err error) {
+		d.fail(offset, err)
+	}
+	if err := s.readTable(); err != nil {
+		d.fail(s.offset, err)
+		return d.result()
+	}
+	for {
+		t, err := s.next()
+		if err == io.EOF {
+			d.line(t.Offset, -1, "%v", serialend)
+			if trailing := len(data) - s.offset; trailing > 0 {
+				offset := s.offset
+				s.offset = len(data)
+				d.line(offset, -1, "%d bytes after serial end", trailing)
+			}
+			return d.result()
+		}
+		if err != nil {
+			d.fail(s.offset, err)
+			return d.result()
+		}
+		switch t.Type {
+		case endtagtype:
+			d.line(t.Offset, t.Depth, "%v %s", t.Type, t.Name)
+		case nodetype:
+			d.line(t.Offset, t.Depth, "%v %d %s", t.Type, t.Key, t.Name)
+		default:
+			d.line(t.Offset, t.Depth, "%v %d %s %s", t.Type, t.Key, t.Name, formatDumpValue(t.Value))
+		}
+	}
+}
+
+func formatDumpValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []byte:
+		return fmt.Sprintf("(%d bytes)", len(v))
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// ----------------------------------------------------------------------------
+
+type dumper struct {
+	writer   io.Writer
+	data     []byte
+	scanner  *scanner
+	firstErr error
+	writeErr error
+}
+
+// line lists the bytes from offset up to the scanner's offset. Lines of the table
+// section, and markers, have a depth of -1, and are listed without one.
+func (d *dumper) line(offset int, depth int, format string, args ...interface{}) {
+	raw := d.data[offset:d.scanner.offset]
+	var hex []string
+	for i, b := range raw {
+		if i == dumpBytes-1 && len(raw) > dumpBytes {
+			hex = append(hex, "..")
+			break
+		}
+		hex = append(hex, fmt.Sprintf("%02x", b))
+	}
+	column, indent := "", ""
+	if depth >= 0 {
+		column, indent = fmt.Sprint(depth), strings.Repeat("  ", depth)
+	}
+	d.write("%08x  %-23s  %2s  %s%s\n", offset, strings.Join(hex, " "), column, indent, fmt.Sprintf(format, args...))
+}
+
+func (d *dumper) fail(offset int, err error) {
+	if d.firstErr == nil {
+		d.firstErr = err
+	}
+	d.write("%08x  %-23s  %2s  error: %v\n", offset, "", "", err)
+}
+
+func (d *dumper) write(format string, args ...interface{}) {
+	if _, err := fmt.Fprintf(d.writer, format, args...); err != nil && d.writeErr == nil {
+		d.writeErr = err
+	}
+}
+
+// result is the first error found in the document, or else of writing the dump
+func (d *dumper) result() error {
+	if d.firstErr != nil {
+		return d.firstErr
+	}
+	return d.writeErr
+}
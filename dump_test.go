@@ -0,0 +1,87 @@
+package binaryxml_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpWithBinaryFixture1(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := ioutil.ReadFile("testdata/test-systemlib-1.binaryxml")
+	assert.NoError(err)
+
+	var buffer bytes.Buffer
+	assert.NoError(binaryxml.Dump(binaryXML, &buffer))
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	assert.Equal("00000000  7c                           table begin", lines[0])
+	assert.Equal(`00000003  72 65 71 75 65 73 74 00      table entry 1 "request"`, lines[2])
+	assert.Equal("0000002d  01 00 05                  0  node 5 BixRequest", lines[9])
+	assert.Equal(`00000030  0b 00 02 56 69 72 74 ..   1    str 2 toNamespace "VirtualMachines"`, lines[10])
+	assert.Equal("00000043  0d                        1    endtag toNamespace", lines[11])
+	assert.True(strings.HasSuffix(lines[len(lines)-1], "serial end"))
+}
+
+func TestDumpStopsAtError(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := ioutil.ReadFile("testdata/test-systemlib-1.binaryxml")
+	assert.NoError(err)
+
+	// Cut the document inside the value of its first string
+	var buffer bytes.Buffer
+	err = binaryxml.Dump(binaryXML[:0x38], &buffer)
+	assert.Error(err)
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	assert.Equal("0000002d  01 00 05                  0  node 5 BixRequest", lines[len(lines)-2])
+	assert.Equal("00000038                               error: "+err.Error(), lines[len(lines)-1])
+}
+
+func TestDumpContinuesPastErrors(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML := []byte{
+		0x7c, 0x00, 0x01, 'a', 0x00, // no table end
+		0x7e,
+		0x01, 0x00, 0x01, // node a
+		0x0b, 0x00, 0x09, 'x', 0x00, // str with unknown key 9
+		0x0d,
+		0xc8, // unknown type
+		0x0d,
+		0x0d, // extra end tag
+		0x7f,
+	}
+
+	var buffer bytes.Buffer
+	err := binaryxml.Dump(binaryXML, &buffer)
+	assert.EqualError(err, "Content is not valid binary XML; missing table end token at offset 5")
+	assert.Equal(`00000000  7c                           table begin
+00000001  00 01                        table length 1
+00000003  61 00                        table entry 1 "a"
+00000005                               error: Content is not valid binary XML; missing table end token at offset 5
+00000005  7e                           serial begin
+00000006  01 00 01                  0  node 1 a
+00000009                               error: Content is not valid binary XML; no table entry for key 9 at offset 9
+00000009  0b 00 09 78 00            1    str 9 ? "x"
+0000000e  0d                        1    endtag ?
+0000000f                               error: Content is not valid binary XML; unexpected unknown type 200 token at offset 15
+00000010  0d                        0  endtag a
+00000011                               error: Content is not valid binary XML; too many close element tags at offset 17
+00000012  7f                           serial end
+`, buffer.String())
+}
+
+// Listing continues past any number of bad tokens, as in captures of corrupted
+// bodies, in constant stack space. The stack is limited so that a fraction of the
+// megabytes of garbage it would take otherwise overflows it.
+func TestDumpLongGarbage(t *testing.T) {
+	assert := assert.New(t)
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+	binaryXML := []byte{0x7c, 0x00, 0x00, 0x7d, 0x7e}
+	binaryXML = append(binaryXML, bytes.Repeat([]byte{0xf0}, 64<<10)...)
+	err := binaryxml.Dump(binaryXML, ioutil.Discard)
+	assert.EqualError(err, "Content is not valid binary XML; unexpected unknown type 240 token at offset 5")
+}
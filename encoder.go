@@ -10,6 +10,7 @@ import (
 	"io"
 	"reflect"
 	"strconv"
+	"strings"
 
 	"github.com/cevaris/ordered_map"
 )
@@ -191,6 +192,14 @@ func (encoder *BinaryXMLEncoder) marshalAttr(start *xml.StartElement, name xml.N
 		return fmt.Errorf("No table entry for element %s", name.Local)
 	}
 
+	// Drill into interfaces and pointers
+	for val.Kind() == reflect.Interface || val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+
 	switch val.Kind() {
 	case reflect.Bool:
 		binary.Write(writer, binary.BigEndian, strtype)
@@ -239,6 +248,9 @@ func (encoder *BinaryXMLEncoder) marshalAttr(start *xml.StartElement, name xml.N
 		binary.Write(writer, binary.BigEndian, uint32(val.Uint()))
 		binary.Write(writer, binary.BigEndian, endtagtype)
 	case reflect.String:
+		if strings.IndexByte(val.String(), 0) >= 0 {
+			return &ElementError{Element: name.Local, Err: ErrNULCharacter}
+		}
 		binary.Write(writer, binary.BigEndian, strtype)
 		binary.Write(writer, binary.BigEndian, elementNumber)
 		writer.Write([]byte(val.String()))
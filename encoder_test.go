@@ -464,3 +464,16 @@ func TestEncodeFixtureB(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(expected, actual)
 }
+
+// ----------------------------------------------------------------------------
+// TestEncodeRejectsNUL
+// ----------------------------------------------------------------------------
+
+func TestEncodeRejectsNUL(t *testing.T) {
+	assert := assert.New(t)
+
+	// A NUL would terminate the string early on the wire
+	var buffer bytes.Buffer
+	fixture := Fixture1{Request: "Test\x00ing"}
+	assert.EqualError(binaryxml.NewEncoder(&buffer).Encode(&fixture), "binaryxml: value of element request: string contains a NUL character")
+}
@@ -0,0 +1,90 @@
+package binaryxml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const malformedErrorStr = "Content is not valid binary XML; %s"
+
+var (
+	// ErrMalformed is matched by the errors reporting a document that isn't valid
+	// binary XML, SyntaxError and UnknownElementIDError.
+	ErrMalformed = errors.New("binaryxml: malformed document")
+
+	// ErrLimitExceeded is matched by LimitError.
+	ErrLimitExceeded = errors.New("binaryxml: document exceeds its limits")
+
+	// ErrNULCharacter is wrapped by the errors encoding a string containing a NUL
+	// character, which would terminate it early on the wire.
+	ErrNULCharacter = errors.New("binaryxml: string contains a NUL character")
+)
+
+// ----------------------------------------------------------------------------
+// Decoding errors
+// ----------------------------------------------------------------------------
+
+// SyntaxError reports a document that isn't valid binary XML.
+type SyntaxError struct {
+	// Offset in the document the error was found at
+	Offset int
+
+	// Type tag of the token the error was found in, or of the marker expected when
+	// one is missing. Errors in element names of the table report the table begin
+	// marker.
+	Token BinXMLType
+
+	// Description of the error
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf(malformedErrorStr+" at offset %d", e.Msg, e.Offset)
+}
+
+// Is reports whether target is ErrMalformed, for errors.Is.
+func (e *SyntaxError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// UnknownElementIDError reports an element referring to a key missing from the table
+// of element names.
+type UnknownElementIDError struct {
+	// Offset of the element token in the document
+	Offset int
+
+	// Key the element refers to
+	ID uint16
+}
+
+func (e *UnknownElementIDError) Error() string {
+	return fmt.Sprintf(malformedErrorStr+" at offset %d", fmt.Sprintf("no table entry for key %d", e.ID), e.Offset)
+}
+
+// Is reports whether target is ErrMalformed, for errors.Is.
+func (e *UnknownElementIDError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// ----------------------------------------------------------------------------
+// Encoding errors
+// ----------------------------------------------------------------------------
+
+// ElementError reports an element whose value can't be encoded.
+type ElementError struct {
+	// Name of the element
+	Element string
+
+	// What is wrong with the value, such as ErrNULCharacter
+	Err error
+}
+
+func (e *ElementError) Error() string {
+	return fmt.Sprintf("binaryxml: value of element %s: %s", e.Element, strings.TrimPrefix(e.Err.Error(), "binaryxml: "))
+}
+
+// Unwrap returns the error of the value, for errors.Is and errors.As.
+func (e *ElementError) Unwrap() error {
+	return e.Err
+}
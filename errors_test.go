@@ -0,0 +1,81 @@
+package binaryxml_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSyntaxErrors checks that ToXML and Validate report the same positional error
+// for malformed documents
+func TestSyntaxErrors(t *testing.T) {
+	assert := assert.New(t)
+	for _, test := range []struct {
+		binaryXML []byte
+		offset    int
+		token     string
+		message   string
+	}{
+		{[]byte{0x7e}, 0, "table begin", "missing table begin token"},
+		{[]byte{0x7c, 0x00}, 2, "table begin", "unexpected end of input"},
+		{[]byte{0x7c, 0x00, 0x01, 'a'}, 4, "table begin", "unterminated string"},
+		{[]byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7e}, 5, "table end", "missing table end token"},
+		{[]byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7f}, 6, "serial begin", "missing serial begin token"},
+		{[]byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x05, 0x00, 0x01, 0x00}, 11, "uint2b", "unexpected end of input"},
+		{[]byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x0c, 0x00, 0x01, 0x00, 0x00, 0x00, 0x09, 0x0d, 0x7f}, 14, "binary", "binary length 9 exceeds the remaining 2 bytes"},
+		{[]byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0xc8, 0x7f}, 7, "unknown type 200", "unexpected unknown type 200 token"},
+		{[]byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x0d, 0x7f}, 7, "endtag", "too many close element tags"},
+		{[]byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x7f}, 10, "serial end", "serial end with 1 unclosed elements"},
+		{[]byte{0x7c, 0x00, 0x00, 0x7d, 0x7e, 0x7f}, 5, "serial end", "missing root element"},
+		{[]byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x0d, 0x01, 0x00, 0x01, 0x0d, 0x7f}, 11, "node", "more than one root element"},
+	} {
+		_, err := binaryxml.ToXML(test.binaryXML)
+		syntaxError, ok := err.(*binaryxml.SyntaxError)
+		if !assert.True(ok, "%s: %v", test.message, err) {
+			continue
+		}
+		assert.Equal(test.offset, syntaxError.Offset, test.message)
+		assert.Equal(test.token, syntaxError.Token.String(), test.message)
+		assert.Equal(test.message, syntaxError.Msg)
+		assert.True(syntaxError.Is(binaryxml.ErrMalformed))
+		assert.Equal(err, binaryxml.Validate(test.binaryXML), test.message)
+	}
+}
+
+func TestUnknownElementIDError(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML := []byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x0b, 0x00, 0x09, 'x', 0x00, 0x0d, 0x0d, 0x7f}
+	_, err := binaryxml.ToXML(binaryXML)
+	assert.Equal(&binaryxml.UnknownElementIDError{Offset: 10, ID: 9}, err)
+	assert.EqualError(err, "Content is not valid binary XML; no table entry for key 9 at offset 10")
+	assert.True(err.(*binaryxml.UnknownElementIDError).Is(binaryxml.ErrMalformed))
+	assert.Equal(err, binaryxml.Validate(binaryXML))
+
+	var decoded struct {
+		A string `xml:"a"`
+	}
+	assert.Equal(err, binaryxml.Decode(binaryXML, &decoded))
+}
+
+func TestLimitErrorIsLimitExceeded(t *testing.T) {
+	assert := assert.New(t)
+	_, err := binaryxml.ToXMLWithOptions([]byte{0x7c, 0x00, 0x00, 0x7d, 0x7e, 0x7f}, binaryxml.XMLOptions{Limits: binaryxml.DecodeLimits{MaxSize: 4}})
+	limitError, ok := err.(*binaryxml.LimitError)
+	assert.True(ok)
+	assert.True(limitError.Is(binaryxml.ErrLimitExceeded))
+	assert.False(limitError.Is(binaryxml.ErrMalformed))
+}
+
+func TestElementErrorWrapsNULCharacter(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	err := binaryxml.NewEncoder(&buffer).Encode(&limitsFixture{Text: "a\x00b"})
+	elementError, ok := err.(*binaryxml.ElementError)
+	if assert.True(ok, "%v", err) {
+		assert.Equal("text", elementError.Element)
+		assert.Equal(binaryxml.ErrNULCharacter, elementError.Unwrap())
+	}
+	assert.EqualError(err, "binaryxml: value of element text: string contains a NUL character")
+}
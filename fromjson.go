@@ -0,0 +1,319 @@
+package binaryxml
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FromJSON converts a JSON document, as written by ToJSON, to binary XML. Objects
+// become nodes, arrays repeated elements, and strings, numbers and booleans strings
+// holding their JSON text. Objects with an "@type" member, as written by
+// ToJSONWithOptions when preserving types, become elements of that type, and the
+// objects of an "@children" array children in that order, so that lossless
+// conversions give back the same document.
+func FromJSON(text string) ([]byte, error) {
+	root, err := parseJSONTree(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := writeTree(&buffer, root); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// ----------------------------------------------------------------------------
+// JSON
+// ----------------------------------------------------------------------------
+
+type jsonParser struct {
+	decoder *json.Decoder
+}
+
+func parseJSONTree(reader io.Reader) (*treeElement, error) {
+	p := jsonParser{decoder: json.NewDecoder(reader)}
+	p.decoder.UseNumber()
+	if err := p.expect(json.Delim('{'), "an object holding the root element"); err != nil {
+		return nil, err
+	}
+	if !p.decoder.More() {
+		return nil, fmt.Errorf("binaryxml: missing root element")
+	}
+	name, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	roots, err := p.elements(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) != 1 || p.decoder.More() {
+		return nil, fmt.Errorf("binaryxml: more than one root element")
+	}
+	if err := p.expect(json.Delim('}'), "the end of the root object"); err != nil {
+		return nil, err
+	}
+	if _, err := p.decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("binaryxml: text after the root object")
+	}
+	return roots[0], nil
+}
+
+// elements parses the value of an object member, an array of elements sharing
+// the member name or a single element
+func (p *jsonParser) elements(name string) ([]*treeElement, error) {
+	tok, err := p.decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	return p.elementsFrom(name, tok)
+}
+
+// elementsFrom parses the value of an object member starting with tok
+func (p *jsonParser) elementsFrom(name string, tok json.Token) ([]*treeElement, error) {
+	if tok != json.Delim('[') {
+		element, err := p.element(name, tok)
+		if err != nil {
+			return nil, err
+		}
+		return []*treeElement{element}, nil
+	}
+	var elements []*treeElement
+	for p.decoder.More() {
+		tok, err := p.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if tok == json.Delim('[') {
+			return nil, fmt.Errorf("binaryxml: nested arrays of element %s have no binary XML representation", name)
+		}
+		element, err := p.element(name, tok)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	_, err := p.decoder.Token()
+	return elements, err
+}
+
+// element parses an element starting with tok
+func (p *jsonParser) element(name string, tok json.Token) (*treeElement, error) {
+	if tok != json.Delim('{') {
+		text, err := jsonText(name, tok)
+		if err != nil {
+			return nil, err
+		}
+		return &treeElement{Type: strtype, Name: name, Value: text}, nil
+	}
+
+	element := &treeElement{Type: nodetype, Name: name}
+	var typeName string
+	var value, typedValue json.Token
+	var members int
+	for p.decoder.More() {
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		members++
+		switch key {
+		case jsonTypeKey:
+			tok, err := p.decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if typeName, ok = tok.(string); !ok {
+				return nil, fmt.Errorf("binaryxml: type of element %s is not a string", name)
+			}
+		case jsonValueKey:
+			if value, err = p.scalar(name); err != nil {
+				return nil, err
+			}
+		case jsonChildrenKey:
+			children, err := p.orderedChildren(name)
+			if err != nil {
+				return nil, err
+			}
+			element.Children = append(element.Children, children...)
+		default:
+			tok, err := p.decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := tok.(json.Delim); !ok && key == jsonTypedValueKey {
+				typedValue = tok
+			}
+			children, err := p.elementsFrom(key, tok)
+			if err != nil {
+				return nil, err
+			}
+			element.Children = append(element.Children, children...)
+		}
+	}
+	if _, err := p.decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	// Typed leaves have their value as their only member besides the type, while
+	// typed elements with children have it under "#value"
+	if typeName != "" && value == nil && members == 2 && typedValue != nil {
+		value = typedValue
+		element.Children = nil
+	}
+	if value == nil {
+		if typeName != "" {
+			return nil, fmt.Errorf("binaryxml: typed element %s has no value", name)
+		}
+		return element, nil
+	}
+	if typeName == "" {
+		typeName = strtype.String()
+	}
+	var err error
+	element.Type, element.Value, err = jsonValue(name, typeName, value)
+	return element, err
+}
+
+// orderedChildren parses an "@children" array of objects, each holding children of
+// the element named name
+func (p *jsonParser) orderedChildren(name string) ([]*treeElement, error) {
+	if err := p.expect(json.Delim('['), fmt.Sprintf("an array of the children of element %s", name)); err != nil {
+		return nil, err
+	}
+	var children []*treeElement
+	for p.decoder.More() {
+		if err := p.expect(json.Delim('{'), fmt.Sprintf("an object holding children of element %s", name)); err != nil {
+			return nil, err
+		}
+		for p.decoder.More() {
+			key, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			elements, err := p.elements(key)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, elements...)
+		}
+		if _, err := p.decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	_, err := p.decoder.Token()
+	return children, err
+}
+
+// scalar parses a string, number, boolean or null
+func (p *jsonParser) scalar(name string) (json.Token, error) {
+	tok, err := p.decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tok.(json.Delim); ok {
+		return nil, fmt.Errorf("binaryxml: value of element %s is not a string, number or boolean", name)
+	}
+	return tok, nil
+}
+
+func (p *jsonParser) key() (string, error) {
+	tok, err := p.decoder.Token()
+	if err != nil {
+		return "", err
+	}
+	return tok.(string), nil
+}
+
+func (p *jsonParser) expect(delim json.Delim, description string) error {
+	tok, err := p.decoder.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("binaryxml: expected %s", description)
+	}
+	return nil
+}
+
+// jsonText is the text of a scalar JSON value
+func jsonText(name string, tok json.Token) (string, error) {
+	switch v := tok.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("binaryxml: unexpected %v in element %s", tok, name)
+}
+
+// jsonValue converts the value of an element to the type named typeName
+func jsonValue(name string, typeName string, tok json.Token) (BinXMLType, interface{}, error) {
+	var dataType BinXMLType
+	for t := int1btype; t <= binarytype; t++ {
+		if t.String() == typeName {
+			dataType = t
+		}
+	}
+	if dataType == undefinedtype {
+		return dataType, nil, fmt.Errorf("binaryxml: unknown type %q of element %s", typeName, name)
+	}
+	text, err := jsonText(name, tok)
+	if err != nil {
+		return dataType, nil, err
+	}
+	var value interface{}
+	switch dataType {
+	case int1btype:
+		var i int64
+		i, err = strconv.ParseInt(text, 10, 8)
+		value = int8(i)
+	case uint1btype:
+		var u uint64
+		u, err = strconv.ParseUint(text, 10, 8)
+		value = uint8(u)
+	case int2btype:
+		var i int64
+		i, err = strconv.ParseInt(text, 10, 16)
+		value = int16(i)
+	case uint2btype:
+		var u uint64
+		u, err = strconv.ParseUint(text, 10, 16)
+		value = uint16(u)
+	case int4btype:
+		var i int64
+		i, err = strconv.ParseInt(text, 10, 32)
+		value = int32(i)
+	case uint4btype:
+		var u uint64
+		u, err = strconv.ParseUint(text, 10, 32)
+		value = uint32(u)
+	case int8btype:
+		value, err = strconv.ParseInt(text, 10, 64)
+	case uint8btype:
+		value, err = strconv.ParseUint(text, 10, 64)
+	case float4type:
+		var f float64
+		f, err = strconv.ParseFloat(text, 32)
+		value = float32(f)
+	case strtype:
+		value = text
+	case binarytype:
+		value, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil {
+		return dataType, nil, fmt.Errorf("binaryxml: invalid %s value %q of element %s: %v", typeName, text, name, err)
+	}
+	return dataType, value, nil
+}
@@ -0,0 +1,144 @@
+package binaryxml_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+type typedJSONFixture struct {
+	XMLName struct{} `xml:"Types"`
+	Int1    int8     `xml:"int1"`
+	Uint2   uint16   `xml:"uint2"`
+	Int4    int32    `xml:"int4"`
+	Uint4   uint32   `xml:"uint4"`
+	Int8    int64    `xml:"int8"`
+	Uint8   uint64   `xml:"uint8"`
+	Float   float32  `xml:"float"`
+	Text    string   `xml:"text"`
+	Data    []byte   `xml:"data"`
+}
+
+// Converting every fixture to JSON preserving types and back gives the same document
+func TestFromJSONRoundTripsFixtures(t *testing.T) {
+	assert := assert.New(t)
+	for i := 1; i <= 6; i++ {
+		fixture := fmt.Sprintf("testdata/test-systemlib-%d.binaryxml", i)
+		binaryXML, err := ioutil.ReadFile(fixture)
+		assert.NoError(err)
+		xml, err := binaryxml.ToXML(binaryXML)
+		assert.NoError(err)
+		json, err := binaryxml.ToJSONWithOptions(binaryXML, binaryxml.JSONOptions{PreserveTypes: true})
+		assert.NoError(err)
+
+		converted, err := binaryxml.FromJSON(json)
+		if !assert.NoError(err, fixture) {
+			continue
+		}
+		roundTripped, err := binaryxml.ToXML(converted)
+		assert.NoError(err)
+		assert.Equal(xml, roundTripped, fixture)
+	}
+}
+
+func TestFromJSONPreservesTypes(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	fixture := typedJSONFixture{
+		Int1: -1, Uint2: 2, Int4: -4, Uint4: 60, Int8: math.MinInt64, Uint8: math.MaxUint64,
+		Float: 1.5, Text: "text", Data: []byte{0, 1, 2},
+	}
+	assert.NoError(binaryxml.NewEncoder(&buffer).Encode(&fixture))
+
+	json, err := binaryxml.ToJSONWithOptions(buffer.Bytes(), binaryxml.JSONOptions{PreserveTypes: true})
+	assert.NoError(err)
+	assert.Equal(`{"Types":{`+
+		`"int1":{"@type":"int1b","value":-1},`+
+		`"uint2":{"@type":"uint2b","value":2},`+
+		`"int4":{"@type":"int4b","value":-4},`+
+		`"uint4":{"@type":"uint4b","value":60},`+
+		`"int8":{"@type":"int8b","value":-9223372036854775808},`+
+		`"uint8":{"@type":"uint8b","value":18446744073709551615},`+
+		`"float":{"@type":"float4","value":1.5},`+
+		`"text":"text",`+
+		`"data":{"@type":"binary","value":"AAEC"}}}`, json)
+
+	binaryXML, err := binaryxml.FromJSON(json)
+	assert.NoError(err)
+	roundTripped, err := binaryxml.ToJSONWithOptions(binaryXML, binaryxml.JSONOptions{PreserveTypes: true})
+	assert.NoError(err)
+	assert.Equal(json, roundTripped)
+}
+
+func TestFromJSONWithTypedElementsHavingChildren(t *testing.T) {
+	assert := assert.New(t)
+	json := `{"a":{"@type":"uint1b","#value":7,"value":"child","b":[{"@type":"float4","value":"NaN"},{}]}}`
+	binaryXML, err := binaryxml.FromJSON(json)
+	assert.NoError(err)
+	roundTripped, err := binaryxml.ToJSONWithOptions(binaryXML, binaryxml.JSONOptions{PreserveTypes: true})
+	assert.NoError(err)
+	assert.Equal(json, roundTripped)
+}
+
+// Siblings of a name interleaved with others keep their order when preserving types,
+// and are grouped at the first of them otherwise
+func TestFromJSONKeepsInterleavedSiblings(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := binaryxml.FromXML("<a><x>1</x><y>2</y><x>3</x></a>")
+	assert.NoError(err)
+	json, err := binaryxml.ToJSONWithOptions(binaryXML, binaryxml.JSONOptions{PreserveTypes: true})
+	assert.NoError(err)
+	assert.Equal(`{"a":{"@children":[{"x":"1"},{"y":"2"},{"x":"3"}]}}`, json)
+	roundTripped, err := binaryxml.FromJSON(json)
+	assert.NoError(err)
+	xml, err := binaryxml.ToXML(roundTripped)
+	assert.NoError(err)
+	assert.Equal("<a><x>1</x><y>2</y><x>3</x></a>", xml)
+
+	json, err = binaryxml.ToJSON(binaryXML)
+	assert.NoError(err)
+	assert.Equal(`{"a":{"x":["1","3"],"y":"2"}}`, json)
+
+	// Adjacent siblings of a name are grouped in both modes
+	binaryXML, err = binaryxml.FromXML("<a><x>1</x><x>3</x><y>2</y></a>")
+	assert.NoError(err)
+	json, err = binaryxml.ToJSONWithOptions(binaryXML, binaryxml.JSONOptions{PreserveTypes: true})
+	assert.NoError(err)
+	assert.Equal(`{"a":{"x":["1","3"],"y":"2"}}`, json)
+}
+
+func TestFromJSONWithoutTypes(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := binaryxml.FromJSON(`{"a":{"b":[1,true,"x",null],"c":{}}}`)
+	assert.NoError(err)
+	xml, err := binaryxml.ToXML(binaryXML)
+	assert.NoError(err)
+	assert.Equal("<a><b>1</b><b>true</b><b>x</b><b></b><c></c></a>", xml)
+}
+
+func TestFromJSONRejectsUnrepresentableJSON(t *testing.T) {
+	assert := assert.New(t)
+	for _, json := range []string{
+		``,
+		`[]`,
+		`{}`,
+		`{"a":1,"b":2}`,
+		`{"a":[1,2]}`,
+		`{"a":{"b":[[1]]}}`,
+		`{"a":{}} {}`,
+		`{"a":{"@type":"uint1b","value":256}}`,
+		`{"a":{"@type":"int4b","value":1.5}}`,
+		`{"a":{"@type":"uint4b"}}`,
+		`{"a":{"@type":"node","value":1}}`,
+		`{"a":{"@type":"binary","value":"!"}}`,
+		`{"a":{"@type":7,"value":1}}`,
+	} {
+		_, err := binaryxml.FromJSON(json)
+		assert.Error(err, json)
+	}
+}
@@ -0,0 +1,79 @@
+package binaryxml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FromXML converts an XML document to binary XML. Elements with child elements
+// become nodes, and other elements strings holding their text, so that ToXML gives
+// back the same elements and text. Attributes, and text mixed with child elements,
+// have no binary XML representation and are rejected.
+func FromXML(text string) ([]byte, error) {
+	root, err := parseXMLTree(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := writeTree(&buffer, root); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func parseXMLTree(reader io.Reader) (*treeElement, error) {
+	decoder := xml.NewDecoder(reader)
+	var root *treeElement
+	var stack []*treeElement
+	var texts [][]byte
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if len(tok.Attr) > 0 {
+				return nil, fmt.Errorf("binaryxml: attributes of element %s have no binary XML representation", tok.Name.Local)
+			}
+			element := &treeElement{Type: nodetype, Name: tok.Name.Local}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, element)
+			} else if root == nil {
+				root = element
+			} else {
+				return nil, fmt.Errorf("binaryxml: more than one root element")
+			}
+			stack = append(stack, element)
+			texts = append(texts, nil)
+		case xml.CharData:
+			if len(stack) > 0 {
+				texts[len(texts)-1] = append(texts[len(texts)-1], tok...)
+			} else if len(bytes.TrimSpace(tok)) > 0 {
+				return nil, fmt.Errorf("binaryxml: text outside of the root element")
+			}
+		case xml.EndElement:
+			element := stack[len(stack)-1]
+			text := string(texts[len(texts)-1])
+			stack = stack[:len(stack)-1]
+			texts = texts[:len(texts)-1]
+			if len(element.Children) == 0 {
+				element.Type = strtype
+				element.Value = text
+			} else if strings.TrimSpace(text) != "" {
+				return nil, fmt.Errorf("binaryxml: text mixed with child elements in element %s has no binary XML representation", element.Name)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("binaryxml: missing root element")
+	}
+	return root, nil
+}
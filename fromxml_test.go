@@ -0,0 +1,46 @@
+package binaryxml_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+// Converting the XML of every fixture back to binary XML gives the same XML
+func TestFromXMLRoundTripsFixtures(t *testing.T) {
+	assert := assert.New(t)
+	for i := 1; i <= 6; i++ {
+		fixture := fmt.Sprintf("testdata/test-systemlib-%d.binaryxml", i)
+		binaryXML, err := ioutil.ReadFile(fixture)
+		assert.NoError(err)
+		xml, err := binaryxml.ToXML(binaryXML)
+		assert.NoError(err)
+
+		converted, err := binaryxml.FromXML(xml)
+		if !assert.NoError(err, fixture) {
+			continue
+		}
+		assert.NoError(binaryxml.Validate(converted), fixture)
+		roundTripped, err := binaryxml.ToXML(converted)
+		assert.NoError(err)
+		assert.Equal(xml, roundTripped, fixture)
+	}
+}
+
+func TestFromXMLRejectsUnrepresentableXML(t *testing.T) {
+	assert := assert.New(t)
+	for _, xml := range []string{
+		`<a x="1"><b>text</b></a>`,
+		`<a>text<b>text</b></a>`,
+		`<a></a><b></b>`,
+		`text<a></a>`,
+		`<a><b></a>`,
+		``,
+	} {
+		_, err := binaryxml.FromXML(xml)
+		assert.Error(err, xml)
+	}
+}
@@ -0,0 +1,209 @@
+//go:build go1.18
+// +build go1.18
+
+package binaryxml_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/BixData/binaryxml"
+)
+
+// Fuzz targets of the decoders and the encoder. Under go test they only run their
+// seeds, the testdata fixtures. Fuzz them with, for example:
+//
+//	go test -run XXX -fuzz FuzzToXML
+
+// Limits fuzzed documents are decoded within
+var fuzzLimits = binaryxml.DecodeLimits{
+	MaxSize:         1 << 16,
+	MaxBinaryLength: 1 << 12,
+	MaxStringLength: 1 << 10,
+	MaxDepth:        64,
+	MaxElements:     1 << 12,
+}
+
+// Bytes decoding a document within fuzzLimits may allocate. The XML of a document
+// is bounded by its elements times the length of their names and values, so this is
+// a generous bound catching allocations sized from lengths read off the input.
+const maxFuzzAllocation = 64 << 20
+
+type fuzzDocument struct {
+	XMLName struct{}   `xml:"FuzzDocument"`
+	Text    string     `xml:"text"`
+	Int     int64      `xml:"int"`
+	Uint    uint64     `xml:"uint"`
+	Small   int8       `xml:"small"`
+	Float   float32    `xml:"float"`
+	Flag    bool       `xml:"flag"`
+	Items   []fuzzItem `xml:"item"`
+}
+
+type fuzzItem struct {
+	Name  string `xml:"name"`
+	Count uint16 `xml:"count"`
+}
+
+func FuzzToXML(f *testing.F) {
+	addFixtureSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecoderInvariants(t, data)
+	})
+}
+
+func FuzzDecode(f *testing.F) {
+	addFixtureSeeds(f)
+	f.Add(encodeFuzzDocument(f, &fuzzDocument{Text: "a < b", Int: -1, Uint: 2, Float: 0.1, Flag: true, Items: []fuzzItem{{"a", 1}, {"b", 2}}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var decoded fuzzDocument
+		if binaryxml.DecodeWithLimits(data, &decoded, fuzzLimits) != nil {
+			return
+		}
+
+		// Encoding what was decoded is stable, decoding and encoding it again
+		encoded := encodeFuzzDocument(t, &decoded)
+		var redecoded fuzzDocument
+		if err := binaryxml.Decode(encoded, &redecoded); err != nil {
+			t.Fatalf("Decoding %q, encoded from %#v: %v", encoded, decoded, err)
+		}
+		reencoded := encodeFuzzDocument(t, &redecoded)
+		if !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("Encoding is unstable: %#v encodes to %q, but %#v to %q", decoded, encoded, redecoded, reencoded)
+		}
+	})
+}
+
+func FuzzEncodeRoundTrip(f *testing.F) {
+	f.Add("text", int64(-1), uint64(1), int8(2), float32(0.1), true, "name")
+	f.Add("<&>]]>\r\n\t", int64(math.MinInt64), uint64(math.MaxUint64), int8(-128), float32(math.Inf(-1)), false, "")
+	f.Add("caf\xe9 \x01 日本語", int64(0), uint64(0), int8(0), float32(-0.0), false, "\x00")
+	f.Fuzz(func(t *testing.T, text string, i int64, u uint64, small int8, float float32, flag bool, name string) {
+		document := fuzzDocument{Text: text, Int: i, Uint: u, Small: small, Float: float, Flag: flag, Items: []fuzzItem{{Name: name}}}
+		var buffer bytes.Buffer
+		err := binaryxml.NewEncoder(&buffer).Encode(&document)
+		if strings.IndexByte(text, 0) >= 0 || strings.IndexByte(name, 0) >= 0 {
+			if err == nil {
+				t.Fatalf("Encoded strings holding NUL: %q, %q", text, name)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded fuzzDocument
+		if err := binaryxml.Decode(buffer.Bytes(), &decoded); err != nil {
+			t.Fatalf("Decoding %#v: %v", document, err)
+		}
+		if decoded.Text != xmlText(text) || decoded.Items[0].Name != xmlText(name) {
+			t.Fatalf("Strings %q and %q decoded as %q and %q", text, name, decoded.Text, decoded.Items[0].Name)
+		}
+		if decoded.Int != i || decoded.Uint != u || decoded.Small != small || decoded.Flag != flag {
+			t.Fatalf("Decoded %#v as %#v", document, decoded)
+		}
+		if math.Float32bits(decoded.Float) != math.Float32bits(float) && !(math.IsNaN(float64(float)) && math.IsNaN(float64(decoded.Float))) {
+			t.Fatalf("Float %v decoded as %v", float, decoded.Float)
+		}
+	})
+}
+
+// ----------------------------------------------------------------------------
+// Invariants
+// ----------------------------------------------------------------------------
+
+// checkDecoderInvariants checks that decoding data, valid or not, doesn't panic and
+// allocates within bounds, and that documents Validate accepts convert to well-formed
+// XML, and to JSON and back losslessly.
+func checkDecoderInvariants(t *testing.T, data []byte) {
+	var text string
+	var err error
+	allocated := allocations(func() {
+		text, err = binaryxml.ToXMLWithOptions(data, binaryxml.XMLOptions{Limits: fuzzLimits})
+	})
+	if allocated > maxFuzzAllocation {
+		t.Fatalf("Converting %d bytes allocated %d bytes", len(data), allocated)
+	}
+	binaryxml.Dump(data, ioutil.Discard)
+	if len(data) > fuzzLimits.MaxSize || binaryxml.Validate(data) != nil {
+		return
+	}
+	if _, isLimitError := err.(*binaryxml.LimitError); isLimitError {
+		return
+	}
+	if err != nil {
+		t.Fatalf("Valid document failed converting to XML: %v", err)
+	}
+	decoder := xml.NewDecoder(strings.NewReader(text))
+	for {
+		if _, err := decoder.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Converted to malformed XML %q: %v", text, err)
+		}
+	}
+
+	options := binaryxml.JSONOptions{PreserveTypes: true}
+	json, err := binaryxml.ToJSONWithOptions(data, options)
+	if err != nil {
+		t.Fatalf("Valid document failed converting to JSON: %v", err)
+	}
+	converted, err := binaryxml.FromJSON(json)
+	if err != nil {
+		t.Fatalf("JSON %s failed converting back: %v", json, err)
+	}
+	if roundTripped, err := binaryxml.ToJSONWithOptions(converted, options); err != nil || roundTripped != json {
+		t.Fatalf("JSON %s converted back to %s: %v", json, roundTripped, err)
+	}
+}
+
+// xmlText is text as it decodes from XML, with bytes that aren't UTF-8 and
+// characters XML can't represent replaced
+func xmlText(text string) string {
+	var buffer bytes.Buffer
+	for _, r := range text {
+		if r == utf8.RuneError || !(r == 0x09 || r == 0x0A || r == 0x0D || r >= 0x20 && r <= 0xD7FF || r >= 0xE000 && r <= 0xFFFD || r >= 0x10000) {
+			r = utf8.RuneError
+		}
+		buffer.WriteRune(r)
+	}
+	return buffer.String()
+}
+
+func allocations(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func addFixtureSeeds(f *testing.F) {
+	fixtures, err := filepath.Glob("testdata/*.binaryxml")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		data, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func encodeFuzzDocument(t testing.TB, document *fuzzDocument) []byte {
+	var buffer bytes.Buffer
+	if err := binaryxml.NewEncoder(&buffer).Encode(document); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
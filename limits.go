@@ -0,0 +1,57 @@
+package binaryxml
+
+import "fmt"
+
+// DecodeLimits bounds the resources decoding a document may use, for documents from
+// untrusted peers. Fields left zero are unlimited.
+type DecodeLimits struct {
+	// Bytes of the document
+	MaxSize int
+
+	// Bytes of a binary value
+	MaxBinaryLength int
+
+	// Bytes of a string value or element name
+	MaxStringLength int
+
+	// Levels of nesting of elements, the root element being at depth 1
+	MaxDepth int
+
+	// Elements of the document
+	MaxElements int
+}
+
+// DefaultDecodeLimits are the limits of ToXML, Decode and the router.
+var DefaultDecodeLimits = DecodeLimits{
+	MaxSize:         16 << 20,
+	MaxBinaryLength: 8 << 20,
+	MaxStringLength: 1 << 20,
+	MaxDepth:        256,
+	MaxElements:     1 << 20,
+}
+
+// LimitError reports a document exceeding one of its DecodeLimits.
+type LimitError struct {
+	// Name of the DecodeLimits field exceeded, such as "MaxDepth"
+	Limit string
+
+	// Value of the limit
+	Max int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("binaryxml: document exceeds %s of %d", e.Limit, e.Max)
+}
+
+// Is reports whether target is ErrLimitExceeded, for errors.Is.
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// checkLimit returns a LimitError if value exceeds max, unless max is zero
+func checkLimit(name string, max int, value int) error {
+	if max > 0 && value > max {
+		return &LimitError{Limit: name, Max: max}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package binaryxml_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+type limitsFixture struct {
+	XMLName struct{}         `xml:"Limits"`
+	Text    string           `xml:"text"`
+	Data    []byte           `xml:"data"`
+	Nested  *limitsNested    `xml:"nested"`
+	Items   []limitsItemType `xml:"item"`
+}
+
+type limitsNested struct {
+	Text string `xml:"text"`
+}
+
+type limitsItemType struct {
+	Name string `xml:"name"`
+}
+
+func encodeLimitsFixture(t *testing.T, fixture *limitsFixture) []byte {
+	var buffer bytes.Buffer
+	if err := binaryxml.NewEncoder(&buffer).Encode(fixture); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecodeLimits(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML := encodeLimitsFixture(t, &limitsFixture{
+		Text:   "0123456789",
+		Data:   make([]byte, 100),
+		Nested: &limitsNested{Text: "nested"},
+		Items:  []limitsItemType{{"a"}, {"b"}},
+	})
+
+	// The document is within default limits, and limits it reaches exactly
+	_, err := binaryxml.ToXML(binaryXML)
+	assert.NoError(err)
+	exact := binaryxml.DecodeLimits{MaxSize: len(binaryXML), MaxBinaryLength: 100, MaxStringLength: 10, MaxDepth: 3, MaxElements: 9}
+	_, err = binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{Limits: exact})
+	assert.NoError(err)
+
+	for _, test := range []struct {
+		limit  string
+		limits binaryxml.DecodeLimits
+	}{
+		{"MaxSize", binaryxml.DecodeLimits{MaxSize: len(binaryXML) - 1}},
+		{"MaxBinaryLength", binaryxml.DecodeLimits{MaxBinaryLength: 99}},
+		{"MaxStringLength", binaryxml.DecodeLimits{MaxStringLength: 9}},
+		{"MaxDepth", binaryxml.DecodeLimits{MaxDepth: 2}},
+		{"MaxElements", binaryxml.DecodeLimits{MaxElements: 8}},
+	} {
+		_, err := binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{Limits: test.limits})
+		if assert.IsType(&binaryxml.LimitError{}, err, test.limit) {
+			limitErr := err.(*binaryxml.LimitError)
+			assert.Equal(test.limit, limitErr.Limit)
+		}
+		decoded := limitsFixture{}
+		assert.IsType(&binaryxml.LimitError{}, binaryxml.DecodeWithLimits(binaryXML, &decoded, test.limits), test.limit)
+		_, err = binaryxml.ToJSONWithOptions(binaryXML, binaryxml.JSONOptions{Limits: test.limits})
+		assert.IsType(&binaryxml.LimitError{}, err, test.limit)
+	}
+}
+
+// Validate and ToJSON apply the default limits, bounding the nesting of the tree
+// they read
+func TestDecodeLimitsOfDeepDocuments(t *testing.T) {
+	assert := assert.New(t)
+	depth := binaryxml.DefaultDecodeLimits.MaxDepth + 1
+	binaryXML := []byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e}
+	for i := 0; i < depth; i++ {
+		binaryXML = append(binaryXML, 0x01, 0x00, 0x01)
+	}
+	binaryXML = append(binaryXML, bytes.Repeat([]byte{0x0d}, depth)...)
+	binaryXML = append(binaryXML, 0x7f)
+
+	assert.EqualError(binaryxml.Validate(binaryXML), "binaryxml: document exceeds MaxDepth of 256")
+	_, err := binaryxml.ToJSON(binaryXML)
+	assert.EqualError(err, "binaryxml: document exceeds MaxDepth of 256")
+	_, err = binaryxml.ToJSONWithOptions(binaryXML, binaryxml.JSONOptions{})
+	assert.NoError(err)
+}
+
+func TestDecodeLimitsOfElementNames(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := ioutil.ReadFile("testdata/test-systemlib-1.binaryxml")
+	assert.NoError(err)
+
+	// The longest element name is BixRequest
+	_, err = binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{Limits: binaryxml.DecodeLimits{MaxStringLength: 10}})
+	assert.EqualError(err, "binaryxml: document exceeds MaxStringLength of 10")
+}
+
+// Lengths of binary values past the end of the document fail without allocating them
+func TestDecodeLimitsOfTruncatedBinary(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML := []byte{0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x0c, 0x00, 0x01, 0xff, 0xff, 0xff, 0xff, 0x00}
+	_, err := binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{})
+	assert.Error(err)
+	_, isLimitError := err.(*binaryxml.LimitError)
+	assert.False(isLimitError)
+}
+
+// Strings longer than the read buffer are limited too
+func TestDecodeLimitsOfLongStrings(t *testing.T) {
+	assert := assert.New(t)
+	text := bytes.Repeat([]byte("x"), 10000)
+	binaryXML := encodeLimitsFixture(t, &limitsFixture{Text: string(text)})
+	_, err := binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{Limits: binaryxml.DecodeLimits{MaxStringLength: 9999}})
+	assert.IsType(&binaryxml.LimitError{}, err)
+	_, err = binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{Limits: binaryxml.DecodeLimits{MaxStringLength: 10000}})
+	assert.NoError(err)
+}
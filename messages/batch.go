@@ -0,0 +1,175 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxBatchSize is the number of pending bytes at which a BatchWriter flushes
+	DefaultMaxBatchSize = 64 * 1024
+
+	// DefaultMaxBatchLatency is how long a BatchWriter holds on to a frame at most
+	DefaultMaxBatchLatency = time.Millisecond
+
+	// Payloads shorter than this are copied into the batch rather than referenced,
+	// since an I/O vector costs more than copying them
+	batchCopyThreshold = 512
+)
+
+var errBatchWriterClosed = errors.New("BatchWriter is closed")
+
+// ----------------------------------------------------------------------------
+// Batch writer
+// ----------------------------------------------------------------------------
+
+// BatchWriter accumulates frames and writes them together using vectored I/O, once
+// MaxBatchSize bytes are pending, MaxBatchLatency after the first pending frame was
+// queued, or when Flush is called. It is safe for concurrent use.
+type BatchWriter struct {
+	Options
+
+	// Pending bytes that trigger a flush
+	MaxBatchSize int
+
+	// Longest a frame stays pending. Zero leaves pending frames until MaxBatchSize is
+	// reached or Flush is called.
+	MaxBatchLatency time.Duration
+
+	writer io.Writer
+
+	lock       sync.Mutex
+	arena      []byte      // frame headers, trailers and short payloads
+	arenaStart int         // start of the arena bytes not yet added to buffers
+	buffers    net.Buffers // pending frames
+	size       int
+	timer      *time.Timer
+	compressed bytes.Buffer
+	err        error
+}
+
+func NewBatchWriter(writer io.Writer) *BatchWriter {
+	return &BatchWriter{
+		Options:         NewOptions(),
+		MaxBatchSize:    DefaultMaxBatchSize,
+		MaxBatchLatency: DefaultMaxBatchLatency,
+		writer:          writer,
+	}
+}
+
+// WriteMessage queues a message. Payloads are written from binaryXML itself, which
+// must not be modified until the batch has been flushed. An error from writing an
+// earlier batch is returned, after which every write fails.
+func (batch *BatchWriter) WriteMessage(param uint8, binaryXML []byte) error {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	if batch.err != nil {
+		return batch.err
+	}
+
+	sentParam, payload, err := batch.encode(param, binaryXML, &batch.compressed)
+	if err != nil {
+		return err
+	}
+	compressed := ParamCompression(sentParam) != ParamCompression(param)
+
+	// Header, then the payload copied alongside, or referenced when it is large enough
+	var header [headerSize]byte
+	header[0] = msgstate_start
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(payload)))
+	header[5] = sentParam
+	batch.arena = append(batch.arena, header[:]...)
+	if compressed || len(payload) < batchCopyThreshold {
+		batch.arena = append(batch.arena, payload...)
+	} else {
+		batch.cutArena()
+		batch.buffers = append(batch.buffers, payload)
+	}
+
+	// Trailer
+	var trailer [trailerSize]byte
+	trailer[0] = msgstate_end
+	binary.BigEndian.PutUint32(trailer[1:], ParamChecksum(sentParam).sum(payload))
+	batch.arena = append(batch.arena, trailer[:]...)
+
+	batch.size += headerSize + len(payload) + trailerSize
+	if batch.size >= batch.MaxBatchSize {
+		return batch.flush()
+	}
+	if batch.timer == nil && batch.MaxBatchLatency > 0 {
+		batch.timer = time.AfterFunc(batch.MaxBatchLatency, batch.flushLater)
+	}
+	return nil
+}
+
+// Flush writes all pending frames.
+func (batch *BatchWriter) Flush() error {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	if batch.err != nil {
+		return batch.err
+	}
+	return batch.flush()
+}
+
+// Close flushes pending frames, after which every write fails. The underlying
+// writer is not closed.
+func (batch *BatchWriter) Close() error {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	if batch.err != nil {
+		return batch.err
+	}
+	err := batch.flush()
+	batch.err = errBatchWriterClosed
+	return err
+}
+
+// Adds the arena bytes written since the last cut to the pending buffers. They are
+// never written to again, and remain valid even once a later append moves the arena.
+func (batch *BatchWriter) cutArena() {
+	if batch.arenaStart < len(batch.arena) {
+		end := len(batch.arena)
+		batch.buffers = append(batch.buffers, batch.arena[batch.arenaStart:end:end])
+		batch.arenaStart = end
+	}
+}
+
+func (batch *BatchWriter) flush() error {
+	if batch.timer != nil {
+		batch.timer.Stop()
+		batch.timer = nil
+	}
+	if batch.size == 0 {
+		return nil
+	}
+	batch.cutArena()
+	buffers := batch.buffers
+	_, err := buffers.WriteTo(batch.writer)
+
+	// Release references to payloads, and reuse the arena
+	for i := range batch.buffers {
+		batch.buffers[i] = nil
+	}
+	batch.buffers = batch.buffers[:0]
+	batch.arena = batch.arena[:0]
+	batch.arenaStart = 0
+	batch.size = 0
+	if err != nil {
+		batch.err = err
+	}
+	return err
+}
+
+func (batch *BatchWriter) flushLater() {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	if batch.err == nil {
+		batch.flush()
+	}
+}
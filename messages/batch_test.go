@@ -0,0 +1,116 @@
+package messages_test
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer is written by BatchWriter timers
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]byte(nil), b.buffer.Bytes()...)
+}
+
+func TestBatchWriter(t *testing.T) {
+	assert := assert.New(t)
+	var buffer lockedBuffer
+	batch := messages.NewBatchWriter(&buffer)
+	batch.MaxBatchLatency = 0
+
+	// Short payloads are copied, long ones referenced
+	payloads := [][]byte{[]byte("first"), bytes.Repeat([]byte("x"), 5000), nil, []byte("last")}
+	var expected []byte
+	for i, payload := range payloads {
+		assert.NoError(batch.WriteMessage(uint8(i), payload))
+		expected = append(expected, frame(t, uint8(i), payload)...)
+	}
+	assert.Empty(buffer.Bytes())
+	assert.NoError(batch.Flush())
+	assert.Equal(expected, buffer.Bytes())
+
+	// Frames are readable in order
+	reader := messages.NewReader(bytes.NewReader(buffer.Bytes()))
+	for i, payload := range payloads {
+		var param uint8
+		var binaryXML []byte
+		assert.NoError(reader.ReadMessage(&param, &binaryXML))
+		assert.Equal(uint8(i), param)
+		assert.Equal(len(payload), len(binaryXML))
+	}
+}
+
+func TestBatchWriterPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	// Size
+	var buffer lockedBuffer
+	batch := messages.NewBatchWriter(&buffer)
+	batch.MaxBatchLatency = 0
+	batch.MaxBatchSize = 100
+	assert.NoError(batch.WriteMessage(0, bytes.Repeat([]byte("x"), 50)))
+	assert.Empty(buffer.Bytes())
+	assert.NoError(batch.WriteMessage(0, bytes.Repeat([]byte("x"), 50)))
+	assert.Len(buffer.Bytes(), 2*(50+11))
+
+	// Latency
+	var delayed lockedBuffer
+	batch = messages.NewBatchWriter(&delayed)
+	batch.MaxBatchLatency = 10 * time.Millisecond
+	assert.NoError(batch.WriteMessage(0, []byte("payload")))
+	assert.Empty(delayed.Bytes())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(frame(t, 0, []byte("payload")), delayed.Bytes())
+}
+
+func TestBatchWriterCompression(t *testing.T) {
+	assert := assert.New(t)
+	var buffer lockedBuffer
+	batch := messages.NewBatchWriter(&buffer)
+	batch.Compression = messages.CompressionSnappy
+	payload := bytes.Repeat([]byte("<metric>Common_CPU</metric>"), 1000)
+	assert.NoError(batch.WriteMessage(0, payload))
+	assert.NoError(batch.WriteMessage(0, payload))
+	assert.NoError(batch.Close())
+
+	reader := messages.NewReader(bytes.NewReader(buffer.Bytes()))
+	for i := 0; i < 2; i++ {
+		var param uint8
+		var binaryXML []byte
+		assert.NoError(reader.ReadMessage(&param, &binaryXML))
+		assert.Equal(messages.CompressionSnappy, messages.ParamCompression(param))
+		assert.Equal(payload, binaryXML)
+	}
+	assert.Error(batch.WriteMessage(0, payload))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestBatchWriterError(t *testing.T) {
+	assert := assert.New(t)
+	batch := messages.NewBatchWriter(failingWriter{})
+	assert.NoError(batch.WriteMessage(0, []byte("payload")))
+	assert.EqualError(batch.Flush(), "connection reset")
+	assert.EqualError(batch.WriteMessage(0, []byte("payload")), "connection reset")
+}
@@ -0,0 +1,107 @@
+package messages
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/cespare/xxhash"
+)
+
+// Checksum identifies the algorithm of the checksum in a message trailer. It is
+// carried in the ParamChecksumMask bits of the param byte, whose zero value is the
+// crc32 understood by every peer. Checksums always occupy the 32 bits of the
+// trailer, so the framing is the same whatever the algorithm.
+type Checksum uint8
+
+const (
+	// IEEE crc32
+	ChecksumCRC32 Checksum = iota
+
+	// Castagnoli crc32, hardware accelerated on most platforms
+	ChecksumCRC32C
+
+	// Lower 32 bits of xxHash64
+	ChecksumXXHash64
+
+	// No checksum, for links that already guarantee integrity such as loopback or TLS
+	ChecksumNone
+)
+
+const (
+	// Bits of the param byte carrying the Checksum of the message
+	ParamChecksumMask uint8 = 3 << checksumShift
+
+	checksumShift = 4
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ParamChecksum returns the checksum algorithm of a message sent with param. Control
+// frames always use ChecksumCRC32.
+func ParamChecksum(param uint8) Checksum {
+	if param&ParamControl != 0 {
+		return ChecksumCRC32
+	}
+	return Checksum((param & ParamChecksumMask) >> checksumShift)
+}
+
+// Param returns the param bits flagging a message checksummed with checksum.
+func (checksum Checksum) Param() uint8 {
+	return uint8(checksum) << checksumShift & ParamChecksumMask
+}
+
+func (checksum Checksum) String() string {
+	switch checksum {
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumXXHash64:
+		return "xxhash64"
+	case ChecksumNone:
+		return "none"
+	}
+	return fmt.Sprintf("Checksum(%d)", uint8(checksum))
+}
+
+func (checksum Checksum) sum(payload []byte) uint32 {
+	switch checksum {
+	case ChecksumCRC32C:
+		return crc32.Checksum(payload, castagnoliTable)
+	case ChecksumXXHash64:
+		return uint32(xxhash.Sum64(payload))
+	case ChecksumNone:
+		return 0
+	}
+	return crc32.ChecksumIEEE(payload)
+}
+
+// newHash returns a hash computing the checksum incrementally, or nil for ChecksumNone.
+func (checksum Checksum) newHash() hash.Hash32 {
+	switch checksum {
+	case ChecksumCRC32C:
+		return crc32.New(castagnoliTable)
+	case ChecksumXXHash64:
+		return xxhash32{xxhash.New()}
+	case ChecksumNone:
+		return nil
+	}
+	return crc32.NewIEEE()
+}
+
+// verify compares the checksum computed for a payload to the one of its trailer.
+func (checksum Checksum) verify(computed uint32, trailer uint32) error {
+	if checksum != ChecksumNone && computed != trailer {
+		return &ChecksumError{Checksum: checksum, Expected: trailer, Actual: computed}
+	}
+	return nil
+}
+
+type xxhash32 struct {
+	hash.Hash64
+}
+
+func (h xxhash32) Sum32() uint32 {
+	return uint32(h.Sum64())
+}
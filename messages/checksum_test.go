@@ -0,0 +1,78 @@
+package messages_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+var checksums = []messages.Checksum{messages.ChecksumCRC32, messages.ChecksumCRC32C, messages.ChecksumXXHash64, messages.ChecksumNone}
+
+func writeChecksummed(t *testing.T, checksum messages.Checksum, payload []byte) []byte {
+	var buffer bytes.Buffer
+	writer := messages.NewWriter(&buffer)
+	writer.Checksum = checksum
+	assert.NoError(t, writer.WriteMessage(messages.ParamResponse, payload))
+	return buffer.Bytes()
+}
+
+func TestChecksum(t *testing.T) {
+	assert := assert.New(t)
+	payload := []byte("<metric>Common_CPU</metric>")
+
+	for _, checksum := range checksums {
+		data := writeChecksummed(t, checksum, payload)
+
+		var param uint8
+		var binaryXML []byte
+		assert.NoError(messages.ReadMessage(bytes.NewReader(data), &param, &binaryXML), checksum.String())
+		assert.Equal(checksum, messages.ParamChecksum(param))
+		assert.Equal(messages.ParamResponse, param&^messages.ParamChecksumMask)
+		assert.Equal(payload, binaryXML)
+
+		reader := messages.NewReader(bytes.NewReader(data))
+		stream, err := reader.ReadMessageStream(&param)
+		assert.NoError(err)
+		streamed, err := ioutil.ReadAll(stream)
+		assert.NoError(err)
+		assert.Equal(payload, streamed)
+
+		reader = messages.NewReader(bytes.NewReader(append([]byte("noise"), data...)))
+		reader.Resync = true
+		assert.NoError(reader.ReadMessage(&param, &binaryXML))
+		assert.Equal(payload, binaryXML)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, checksum := range checksums {
+		data := writeChecksummed(t, checksum, []byte("<metric>Common_CPU</metric>"))
+		data[10]++
+
+		var param uint8
+		var binaryXML []byte
+		err := messages.ReadMessage(bytes.NewReader(data), &param, &binaryXML)
+		if checksum == messages.ChecksumNone {
+			assert.NoError(err)
+			continue
+		}
+		assert.EqualError(err, "Malformed message; "+checksum.String()+" checksum does not match")
+
+		reader := messages.NewReader(bytes.NewReader(data))
+		stream, err := reader.ReadMessageStream(&param)
+		assert.NoError(err)
+		_, err = ioutil.ReadAll(stream)
+		assert.Error(err)
+	}
+}
+
+func TestChecksumDefault(t *testing.T) {
+	// Frames are unchanged for peers that predate checksum selection
+	payload := []byte("<metric>Common_CPU</metric>")
+	assert.Equal(t, frame(t, messages.ParamResponse, payload), writeChecksummed(t, messages.ChecksumCRC32, payload))
+}
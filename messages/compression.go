@@ -0,0 +1,210 @@
+package messages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the algorithm a payload is compressed with. It is carried
+// in the ParamCompressionMask bits of the param byte.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+	CompressionSnappy
+)
+
+const (
+	// Bits of the param byte carrying the Compression of the payload
+	ParamCompressionMask uint8 = 3 << compressionShift
+
+	compressionShift = 2
+)
+
+// ParamCompression returns the compression of a payload sent with param. Control
+// frames are never compressed.
+func ParamCompression(param uint8) Compression {
+	if param&ParamControl != 0 {
+		return CompressionNone
+	}
+	return Compression((param & ParamCompressionMask) >> compressionShift)
+}
+
+// Param returns the param bits flagging a payload compressed with compression.
+func (compression Compression) Param() uint8 {
+	return uint8(compression) << compressionShift & ParamCompressionMask
+}
+
+func (compression Compression) String() string {
+	switch compression {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("Compression(%d)", uint8(compression))
+}
+
+// ----------------------------------------------------------------------------
+// Codecs
+// ----------------------------------------------------------------------------
+
+// Codecs are pooled, as creating them costs far more than compressing a message,
+// notably for zstd.
+var (
+	gzipWriters   sync.Pool
+	gzipReaders   sync.Pool
+	zstdEncoders  sync.Pool
+	zstdDecoders  sync.Pool
+	snappyWriters sync.Pool
+	snappyReaders sync.Pool
+)
+
+var errCodecClosed = errors.New("Codec already closed")
+
+// pooledWriter is a compressor returned to its pool once closed.
+type pooledWriter struct {
+	io.WriteCloser
+	pool *sync.Pool
+}
+
+func (writer *pooledWriter) Close() error {
+	if writer.pool == nil {
+		return errCodecClosed
+	}
+	err := writer.WriteCloser.Close()
+	writer.pool.Put(writer.WriteCloser)
+	writer.pool = nil
+	return err
+}
+
+// pooledReader is a decompressor returned to its pool once closed.
+type pooledReader struct {
+	io.Reader
+	pool *sync.Pool
+}
+
+func (reader *pooledReader) Close() error {
+	if reader.pool == nil {
+		return errCodecClosed
+	}
+	reader.pool.Put(reader.Reader)
+	reader.pool = nil
+	return nil
+}
+
+// newCompressor returns a pooled compressor writing to writer, which Close returns to
+// its pool.
+func newCompressor(compression Compression, writer io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		if compressor, ok := gzipWriters.Get().(*gzip.Writer); ok {
+			compressor.Reset(writer)
+			return &pooledWriter{compressor, &gzipWriters}, nil
+		}
+		return &pooledWriter{gzip.NewWriter(writer), &gzipWriters}, nil
+	case CompressionZstd:
+		if encoder, ok := zstdEncoders.Get().(*zstd.Encoder); ok {
+			encoder.Reset(writer)
+			return &pooledWriter{encoder, &zstdEncoders}, nil
+		}
+		encoder, err := zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &pooledWriter{encoder, &zstdEncoders}, nil
+	case CompressionSnappy:
+		if compressor, ok := snappyWriters.Get().(*snappy.Writer); ok {
+			compressor.Reset(writer)
+			return &pooledWriter{compressor, &snappyWriters}, nil
+		}
+		return &pooledWriter{snappy.NewBufferedWriter(writer), &snappyWriters}, nil
+	}
+	return nil, fmt.Errorf("Unsupported compression %v", compression)
+}
+
+// newDecompressor returns a pooled decompressor reading from reader, which Close
+// returns to its pool.
+func newDecompressor(compression Compression, reader io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		if decompressor, ok := gzipReaders.Get().(*gzip.Reader); ok {
+			if err := decompressor.Reset(reader); err != nil {
+				gzipReaders.Put(decompressor)
+				return nil, err
+			}
+			return &pooledReader{decompressor, &gzipReaders}, nil
+		}
+		decompressor, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return &pooledReader{decompressor, &gzipReaders}, nil
+	case CompressionZstd:
+		decoder, ok := zstdDecoders.Get().(*zstd.Decoder)
+		if !ok {
+			var err error
+			decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := decoder.Reset(reader); err != nil {
+			zstdDecoders.Put(decoder)
+			return nil, err
+		}
+		return &pooledReader{decoder, &zstdDecoders}, nil
+	case CompressionSnappy:
+		if decompressor, ok := snappyReaders.Get().(*snappy.Reader); ok {
+			decompressor.Reset(reader)
+			return &pooledReader{decompressor, &snappyReaders}, nil
+		}
+		return &pooledReader{snappy.NewReader(reader), &snappyReaders}, nil
+	}
+	return nil, fmt.Errorf("Unsupported compression %v", compression)
+}
+
+// compress appends the compressed payload to buffer.
+func compress(compression Compression, payload []byte, buffer *bytes.Buffer) error {
+	compressor, err := newCompressor(compression, buffer)
+	if err != nil {
+		return err
+	}
+	if _, err := compressor.Write(payload); err != nil {
+		compressor.Close()
+		return err
+	}
+	return compressor.Close()
+}
+
+// decompress decompresses payload into buffer, reusing its capacity. Payloads that
+// decompress to more than max bytes are rejected.
+func decompress(compression Compression, payload []byte, buffer []byte, max uint32) ([]byte, error) {
+	decompressor, err := newDecompressor(compression, bytes.NewReader(payload))
+	if err != nil {
+		return buffer[:0], &FrameError{Msg: fmt.Sprintf("%v payload", compression), Err: err}
+	}
+	defer decompressor.Close()
+	output := bytes.NewBuffer(buffer[:0])
+	n, err := io.Copy(output, io.LimitReader(decompressor, int64(max)+1))
+	if err != nil {
+		return output.Bytes(), &FrameError{Msg: fmt.Sprintf("%v payload", compression), Err: err}
+	}
+	if n > int64(max) {
+		return output.Bytes(), &TooLongError{Max: max}
+	}
+	return output.Bytes(), nil
+}
@@ -0,0 +1,90 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMalformed is matched by the errors reporting a frame that doesn't follow the
+	// framing, FrameError and ChecksumError.
+	ErrMalformed = errors.New("Malformed message")
+
+	// ErrMessageTooLong is matched by TooLongError.
+	ErrMessageTooLong = errors.New("message length too long")
+
+	// ErrChannelClosed is returned using a Mux channel after it was closed, and
+	// writing on one the peer closed.
+	ErrChannelClosed = errors.New("Channel is closed")
+)
+
+// FrameError reports a malformed frame, such as a missing start or end token, or a
+// compressed payload that fails decompressing.
+type FrameError struct {
+	// Description of the error
+	Msg string
+
+	// Underlying error, such as the one of a decompressor
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Malformed message; %s: %v", e.Msg, e.Err)
+	}
+	return "Malformed message; " + e.Msg
+}
+
+// Is reports whether target is ErrMalformed, for errors.Is.
+func (e *FrameError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// Unwrap returns the underlying error, for errors.Is and errors.As.
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumError reports a frame whose payload doesn't match the checksum of its
+// trailer.
+type ChecksumError struct {
+	// Algorithm of the checksum
+	Checksum Checksum
+
+	// Checksum carried in the trailer
+	Expected uint32
+
+	// Checksum computed for the payload received
+	Actual uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Malformed message; %v checksum does not match", e.Checksum)
+}
+
+// Is reports whether target is ErrMalformed, for errors.Is.
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// TooLongError reports a message exceeding the largest size accepted.
+type TooLongError struct {
+	// Length announced by the frame, or zero when the message is only known to be
+	// longer than Max, such as a payload decompressing to more.
+	Length uint32
+
+	// Largest size accepted
+	Max uint32
+}
+
+func (e *TooLongError) Error() string {
+	if e.Length == 0 {
+		return fmt.Sprintf("message length too long - more than %d", e.Max)
+	}
+	return fmt.Sprintf("message length too long - %d", e.Length)
+}
+
+// Is reports whether target is ErrMessageTooLong, for errors.Is.
+func (e *TooLongError) Is(target error) bool {
+	return target == ErrMessageTooLong
+}
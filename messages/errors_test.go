@@ -0,0 +1,80 @@
+package messages_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumError(t *testing.T) {
+	assert := assert.New(t)
+	data := frame(t, 0, []byte("payload"))
+	data[8]++
+
+	var param uint8
+	var binaryXML []byte
+	err := messages.ReadMessage(bytes.NewReader(data), &param, &binaryXML)
+	checksumError, ok := err.(*messages.ChecksumError)
+	if assert.True(ok, "%v", err) {
+		assert.Equal(messages.ChecksumCRC32, checksumError.Checksum)
+		assert.Equal(binary.BigEndian.Uint32(data[len(data)-4:]), checksumError.Expected)
+		assert.Equal(crc32.ChecksumIEEE(data[6:len(data)-5]), checksumError.Actual)
+		assert.True(checksumError.Is(messages.ErrMalformed))
+	}
+}
+
+func TestFrameError(t *testing.T) {
+	assert := assert.New(t)
+	for _, test := range []struct {
+		data    []byte
+		message string
+	}{
+		{[]byte("noise"), "missing start token"},
+		{append(frame(t, 0, []byte("payload"))[:13], 0x00, 0, 0, 0, 0), "missing end token"},
+	} {
+		var param uint8
+		var binaryXML []byte
+		err := messages.ReadMessage(bytes.NewReader(test.data), &param, &binaryXML)
+		assert.Equal(&messages.FrameError{Msg: test.message}, err)
+		assert.EqualError(err, "Malformed message; "+test.message)
+		assert.True(err.(*messages.FrameError).Is(messages.ErrMalformed))
+	}
+
+	// Payloads failing decompression carry the error of the decompressor
+	data := frame(t, messages.CompressionGzip.Param(), []byte("not gzip"))
+	var param uint8
+	var binaryXML []byte
+	err := messages.ReadMessage(bytes.NewReader(data), &param, &binaryXML)
+	frameError, ok := err.(*messages.FrameError)
+	if assert.True(ok, "%v", err) {
+		assert.Equal("gzip payload", frameError.Msg)
+		assert.Error(frameError.Unwrap())
+	}
+}
+
+func TestTooLongError(t *testing.T) {
+	assert := assert.New(t)
+	data := frame(t, 0, bytes.Repeat([]byte("x"), 100))
+	reader := messages.NewReader(bytes.NewReader(data))
+	reader.MaxMessageSize = 99
+	var param uint8
+	var binaryXML []byte
+	err := reader.ReadMessage(&param, &binaryXML)
+	assert.Equal(&messages.TooLongError{Length: 100, Max: 99}, err)
+	assert.True(err.(*messages.TooLongError).Is(messages.ErrMessageTooLong))
+
+	// Payloads decompressing to more than the limit are only known to exceed it
+	var buffer bytes.Buffer
+	writer := messages.NewWriter(&buffer)
+	writer.Compression = messages.CompressionGzip
+	assert.NoError(writer.WriteMessage(0, bytes.Repeat([]byte("x"), 4096)))
+	reader = messages.NewReader(&buffer)
+	reader.MaxMessageSize = 1024
+	err = reader.ReadMessage(&param, &binaryXML)
+	assert.Equal(&messages.TooLongError{Max: 1024}, err)
+	assert.EqualError(err, "message length too long - more than 1024")
+}
@@ -0,0 +1,108 @@
+//go:build go1.18
+// +build go1.18
+
+package messages_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/BixData/binaryxml/messages"
+)
+
+// Largest payload fuzzed readers accept
+const maxFuzzMessageSize = 1 << 16
+
+// FuzzReadMessage checks that reading arbitrary input, in either reader mode, doesn't
+// panic, respects MaxMessageSize, allocates within bounds, and that every message read
+// frames back to itself.
+func FuzzReadMessage(f *testing.F) {
+	fixtures, err := filepath.Glob("../testdata/*.binaryxml")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		data, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(fuzzFrame(f, messages.Options{}, 0, data))
+	}
+	payload := bytes.Repeat([]byte("compressible "), 200)
+	f.Add(fuzzFrame(f, messages.Options{Compression: messages.CompressionGzip}, 0, payload))
+	f.Add(fuzzFrame(f, messages.Options{Checksum: messages.ChecksumXXHash64}, messages.ParamResponse, payload))
+	f.Add(fuzzFrame(f, messages.Options{}, messages.ControlPing, nil))
+	f.Add(append(fuzzFrame(f, messages.Options{}, 0, []byte("first")), fuzzFrame(f, messages.Options{}, messages.ParamMore, []byte("second"))...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, resync := range []bool{false, true} {
+			var count int
+			allocated := allocations(func() {
+				count = readFuzzedMessages(t, data, resync)
+			})
+
+			// Decompressors hold state of their own, on top of the payloads
+			if limit := uint64(64<<20 + 8*len(data) + count*2*maxFuzzMessageSize); allocated > limit {
+				t.Fatalf("Reading %d bytes allocated %d bytes", len(data), allocated)
+			}
+		}
+	})
+}
+
+func readFuzzedMessages(t *testing.T, data []byte, resync bool) int {
+	reader := messages.NewReader(bytes.NewReader(data))
+	reader.MaxMessageSize = maxFuzzMessageSize
+	reader.Resync = resync
+	var count int
+	for ; ; count++ {
+		var param uint8
+		var payload []byte
+		if err := reader.ReadMessage(&param, &payload); err != nil {
+			return count
+		}
+		if len(payload) > maxFuzzMessageSize {
+			t.Fatalf("Read a %d byte message past MaxMessageSize", len(payload))
+		}
+
+		// Messages are written back uncompressed, as compression is flagged again when the
+		// payload is compressed
+		if param&messages.ParamControl == 0 {
+			param &^= messages.ParamCompressionMask
+		}
+		var buffer bytes.Buffer
+		writer := messages.NewWriter(&buffer)
+		writer.Options = messages.Options{}
+		if err := writer.WriteMessage(param, payload); err != nil {
+			t.Fatalf("Writing back param %#x: %v", param, err)
+		}
+		var readParam uint8
+		var readPayload []byte
+		if err := messages.NewReader(&buffer).ReadMessage(&readParam, &readPayload); err != nil {
+			t.Fatalf("Reading back param %#x: %v", param, err)
+		}
+		if readParam != param || !bytes.Equal(readPayload, payload) {
+			t.Fatalf("Message %#x %q read back as %#x %q", param, payload, readParam, readPayload)
+		}
+	}
+}
+
+func fuzzFrame(f *testing.F, options messages.Options, param uint8, payload []byte) []byte {
+	var buffer bytes.Buffer
+	writer := messages.NewWriter(&buffer)
+	writer.Options = options
+	if err := writer.WriteMessage(param, payload); err != nil {
+		f.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func allocations(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
@@ -0,0 +1,45 @@
+package messages
+
+import "sync"
+
+// Buffers grown beyond this size are left to the garbage collector rather than
+// pooled, so that an occasional large message doesn't pin memory
+const maxPooledSize = 1 << 20
+
+var messagePool = sync.Pool{New: func() interface{} { return &Message{} }}
+
+// ----------------------------------------------------------------------------
+// Pooled message
+// ----------------------------------------------------------------------------
+
+// Message is a message read into a pooled buffer. Release returns it to the pool,
+// after which neither the Message nor its BinaryXML may be used.
+type Message struct {
+	Param     uint8
+	BinaryXML []byte
+}
+
+// Release returns the message to the pool. Releasing a nil Message does nothing.
+func (msg *Message) Release() {
+	if msg == nil {
+		return
+	}
+	if cap(msg.BinaryXML) > maxPooledSize {
+		msg.BinaryXML = nil
+	}
+	msg.Param = 0
+	msg.BinaryXML = msg.BinaryXML[:0]
+	messagePool.Put(msg)
+}
+
+// Next reads the next message into a pooled buffer, so that reading messages
+// doesn't allocate once buffers of the sizes in use have been pooled. The caller
+// must Release the message once done with it.
+func (reader *Reader) Next() (*Message, error) {
+	msg := messagePool.Get().(*Message)
+	if err := reader.ReadMessage(&msg.Param, &msg.BinaryXML); err != nil {
+		msg.Release()
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,60 @@
+package messages_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+// endlessReader repeats data forever
+type endlessReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.offset:])
+	r.offset = (r.offset + n) % len(r.data)
+	return n, nil
+}
+
+func TestReaderNext(t *testing.T) {
+	assert := assert.New(t)
+	data := append(frame(t, 1, []byte("first")), frame(t, 2, []byte("second"))...)
+	reader := messages.NewReader(bytes.NewReader(data))
+
+	msg, err := reader.Next()
+	assert.NoError(err)
+	assert.Equal(uint8(1), msg.Param)
+	assert.Equal("first", string(msg.BinaryXML))
+	msg.Release()
+
+	msg, err = reader.Next()
+	assert.NoError(err)
+	assert.Equal(uint8(2), msg.Param)
+	assert.Equal("second", string(msg.BinaryXML))
+	msg.Release()
+
+	msg, err = reader.Next()
+	assert.Equal(io.EOF, err)
+	assert.Nil(msg)
+	msg.Release()
+}
+
+func TestReaderNextAllocations(t *testing.T) {
+	payload := bytes.Repeat([]byte("<metric>Common_CPU</metric>"), 100)
+	reader := messages.NewReader(&endlessReader{data: frame(t, 0, payload)})
+
+	// Steady state reading doesn't allocate
+	allocs := testing.AllocsPerRun(100, func() {
+		msg, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Release()
+	})
+	assert.Equal(t, 0.0, allocs)
+}
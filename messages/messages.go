@@ -2,9 +2,6 @@ package messages
 
 import (
 	"encoding/binary"
-	"errors"
-	"fmt"
-	"hash/crc32"
 	"io"
 )
 
@@ -13,65 +10,59 @@ const (
 	msgstate_end   uint8 = 123
 )
 
-// ----------------------------------------------------------------------------
-// Reads a message
-// ----------------------------------------------------------------------------
+// Flags carried in the param byte of a message
+const (
+	// Set on every message the router sends in reply to a request
+	ParamResponse uint8 = 1 << 0
 
-func ReadMessage(reader io.Reader, param *uint8, binaryXML *[]byte) error {
-	// Read message start token
-	var token uint8
-	if err := binary.Read(reader, binary.BigEndian, &token); err != nil {
-		return err
-	}
-	if token != msgstate_start {
-		return fmt.Errorf("Malformed message; missing start token")
-	}
+	// Set on a response that will be followed by further responses to the same request
+	ParamMore uint8 = 1 << 1
 
-	// Read message length
-	var messageLength uint32
-	if err := binary.Read(reader, binary.BigEndian, &messageLength); err != nil {
-		return err
-	}
+	// Set on a message sent on a Mux channel, whose payload starts with the channel id
+	ParamChannel uint8 = 1 << 6
 
-	// Read param
-	if err := binary.Read(reader, binary.BigEndian, param); err != nil {
-		return err
-	}
+	// Set on a control frame, whose other param bits carry the control type
+	ParamControl uint8 = 1 << 7
+)
 
-	if messageLength > 2e6 {
-		errMsg := fmt.Sprintf("message length too long - %d", messageLength)
-		return errors.New(errMsg)
-	}
+// Protocol versioning, exchanged in handshakes
+const (
+	// Version of the framing implemented by this package
+	ProtocolVersion uint32 = 1
 
-	// Read message
-	*binaryXML = make([]byte, messageLength)
-	if _, err := io.ReadFull(reader, *binaryXML); err != nil {
-		return err
-	}
+	// Param bits understood by this package
+	SupportedParams = ParamResponse | ParamMore | ParamCompressionMask | ParamChecksumMask | ParamChannel | ParamControl
 
-	// Read message end token
-	if err := binary.Read(reader, binary.BigEndian, &token); err != nil {
-		return err
-	}
-	if token != msgstate_end {
-		return fmt.Errorf("Malformed message; missing end token")
-	}
+	// Control frame opening a connection, whose payload is a binaryxml.BixHello
+	ControlHello uint8 = ParamControl | 2
+)
 
-	// Read crc32 checksum
-	var crcFromPayload uint32
-	if err := binary.Read(reader, binary.BigEndian, &crcFromPayload); err != nil {
-		return err
-	}
+// Keepalive control frames. A peer receiving a ping answers with a pong carrying the
+// same payload.
+const (
+	ControlPing uint8 = ParamControl | 3
+	ControlPong uint8 = ParamControl | 4
+)
 
-	// Compute our own crc32 for the message, and reject message whose checksum doesn't match
-	locallyComputedCrc := crc32.ChecksumIEEE(*binaryXML)
-	if locallyComputedCrc != crcFromPayload {
-		return fmt.Errorf("Malformed message; crc32 checksum does not match")
-	}
+// ----------------------------------------------------------------------------
+// Reads a message
+// ----------------------------------------------------------------------------
 
-	return nil
+// ReadMessage reads a message of up to DefaultMaxMessageSize bytes into a newly
+// allocated slice, leaving the slice binaryXML pointed to untouched. Use a Reader to
+// configure the limit, to reuse buffers, or to stream large payloads.
+func ReadMessage(reader io.Reader, param *uint8, binaryXML *[]byte) error {
+	messageReader := Reader{MaxMessageSize: DefaultMaxMessageSize, reader: reader}
+	var payload []byte
+	err := messageReader.ReadMessage(param, &payload)
+	*binaryXML = payload
+	return err
 }
 
+// ----------------------------------------------------------------------------
+// Writes a message
+// ----------------------------------------------------------------------------
+
 func WriteMessage(writer io.Writer, param uint8, binaryXML []byte) error {
 	// Write message start token
 	if err := binary.Write(writer, binary.BigEndian, msgstate_start); err != nil {
@@ -98,8 +89,8 @@ func WriteMessage(writer io.Writer, param uint8, binaryXML []byte) error {
 		return err
 	}
 
-	// Write crc32 checksum
-	crc := crc32.ChecksumIEEE(binaryXML)
+	// Write checksum, with the algorithm flagged in param
+	crc := ParamChecksum(param).sum(binaryXML)
 	if err := binary.Write(writer, binary.BigEndian, crc); err != nil {
 		return err
 	}
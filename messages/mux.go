@@ -0,0 +1,616 @@
+package messages
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultFragmentSize is the largest chunk of a message a Mux sends in one frame
+	DefaultFragmentSize = 16 * 1024
+
+	// DefaultChannelWindow is the number of bytes a Mux peer may send on a channel
+	// ahead of window updates
+	DefaultChannelWindow = 256 * 1024
+
+	// DefaultMaxChannels is the number of channels a Mux keeps open at most
+	DefaultMaxChannels = 64
+
+	// MaxChannelID is the largest id of a Mux channel
+	MaxChannelID = channelFragmented - 1
+
+	// Control frame granting a peer more window on a channel. Its payload is the
+	// channel id as a uint16, followed by the window increment as a uint32.
+	ControlWindowUpdate uint8 = ParamControl | 1
+
+	// Control frame closing a channel. Its payload is the channel id as a uint16.
+	ControlChannelClose uint8 = ParamControl | 2
+
+	// Set in the channel id of every fragment of a message but the last
+	channelFragmented = 1 << 15
+
+	channelIDSize    = 2
+	windowUpdateSize = 6
+)
+
+// ----------------------------------------------------------------------------
+// Mux
+// ----------------------------------------------------------------------------
+
+// Mux multiplexes independent channels of messages over one connection. Messages on
+// channels other than 0 are flagged with ParamChannel, prefixed with their channel
+// id, and split into fragments, so that a large message on one channel doesn't hold
+// up the others. Each of these channels is flow controlled: a peer may only have
+// ChannelWindow bytes in flight on a channel until the receiving end consumes them
+// and grants it more with a ControlWindowUpdate frame. Channel 0 carries plain
+// messages, as exchanged with peers that don't multiplex, and so has no window:
+// instead, Run stops reading while ChannelWindow bytes of channel 0 messages wait to
+// be consumed, leaving the peer to the flow control of the connection.
+//
+// Channels other than 0 are closed by both ends once done with, freeing their id
+// and window, so that a connection may go through any number of channels over its
+// life while MaxChannels are open at once.
+//
+// Run must be called for a Mux to receive messages and window updates, which are
+// sent by a goroutine of its own.
+type Mux struct {
+	Options
+
+	// Largest chunk of a message sent in one frame
+	FragmentSize int
+
+	// Bytes a peer may send on a channel ahead of window updates. Both ends of a
+	// connection must agree on it.
+	ChannelWindow uint32
+
+	// Largest message accepted, once reassembled and decompressed
+	MaxMessageSize uint32
+
+	// Channels open at most, including those opened by the peer and those not yet
+	// closed by both ends. Frames opening more fail the connection.
+	MaxChannels int
+
+	reader *Reader
+	frame  []byte
+
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+
+	lock     sync.Mutex
+	channels map[uint16]*Channel
+	err      error
+
+	// Window increments waiting to be sent, signalled on updateReady
+	updates     map[uint16]uint32
+	updateReady chan struct{}
+}
+
+func NewMux(conn io.ReadWriter) *Mux {
+	return &Mux{
+		Options:        NewOptions(),
+		FragmentSize:   DefaultFragmentSize,
+		ChannelWindow:  DefaultChannelWindow,
+		MaxMessageSize: DefaultMaxMessageSize,
+		MaxChannels:    DefaultMaxChannels,
+		reader:         NewReader(conn),
+		writer:         bufio.NewWriter(conn),
+		channels:       make(map[uint16]*Channel),
+		updates:        make(map[uint16]uint32),
+		updateReady:    make(chan struct{}, 1),
+	}
+}
+
+// Channel returns the channel with the given id, opening it if needed. Panics if id
+// is greater than MaxChannelID.
+func (mux *Mux) Channel(id uint16) *Channel {
+	if id > MaxChannelID {
+		panic(fmt.Sprintf("messages: channel id %d out of range", id))
+	}
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	if ch, ok := mux.channels[id]; ok {
+		return ch
+	}
+	return mux.open(id)
+}
+
+// peerChannel returns the channel a frame from the peer is for, opening it unless
+// MaxChannels channels are already open.
+func (mux *Mux) peerChannel(id uint16) (*Channel, error) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	if ch, ok := mux.channels[id]; ok {
+		return ch, nil
+	}
+	if len(mux.channels) >= mux.MaxChannels {
+		return nil, &FrameError{Msg: fmt.Sprintf("channel %d exceeds the %d open channels allowed", id, mux.MaxChannels)}
+	}
+	return mux.open(id), nil
+}
+
+// open a channel. Must be called with mux.lock held.
+func (mux *Mux) open(id uint16) *Channel {
+	ch := &Channel{ID: id, mux: mux, window: int64(mux.ChannelWindow), err: mux.err}
+	ch.cond = sync.NewCond(&ch.lock)
+	mux.channels[id] = ch
+	return ch
+}
+
+// Run reads frames and dispatches them to their channels until the connection fails,
+// in which case every channel fails with the same error.
+func (mux *Mux) Run() error {
+	mux.reader.MaxMessageSize = mux.MaxMessageSize
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go mux.sendWindowUpdates(stopped)
+	for {
+		var param uint8
+		err := mux.reader.readFrame(&param, &mux.frame, &mux.frame)
+		if err == nil {
+			err = mux.dispatch(param, mux.frame)
+		}
+		if err != nil {
+			mux.fail(err)
+			return err
+		}
+	}
+}
+
+func (mux *Mux) dispatch(param uint8, payload []byte) error {
+	switch {
+	case param == ControlWindowUpdate:
+		if len(payload) != windowUpdateSize {
+			return &FrameError{Msg: "invalid window update"}
+		}
+		id := binary.BigEndian.Uint16(payload)
+		if id > MaxChannelID {
+			return &FrameError{Msg: "invalid window update"}
+		}
+
+		// Only channels sent on are granted window, and those are open
+		mux.lock.Lock()
+		ch, ok := mux.channels[id]
+		mux.lock.Unlock()
+		if ok {
+			ch.grant(binary.BigEndian.Uint32(payload[channelIDSize:]))
+		}
+		return nil
+	case param == ControlChannelClose:
+		if len(payload) != channelIDSize {
+			return &FrameError{Msg: "invalid channel close"}
+		}
+		id := binary.BigEndian.Uint16(payload)
+		if id == 0 || id > MaxChannelID {
+			return &FrameError{Msg: "invalid channel close"}
+		}
+
+		// Channels the peer closes were used, and so are open until both ends close them
+		mux.lock.Lock()
+		defer mux.lock.Unlock()
+		if ch, ok := mux.channels[id]; ok {
+			ch.peerClose()
+		}
+		return nil
+	case param&ParamControl != 0:
+		// Control frames of later versions of the protocol
+		return nil
+	case param&ParamChannel != 0:
+		if len(payload) < channelIDSize {
+			return &FrameError{Msg: "missing channel id"}
+		}
+		id := binary.BigEndian.Uint16(payload)
+		ch, err := mux.peerChannel(id &^ channelFragmented)
+		if err != nil {
+			return err
+		}
+		return ch.receive(param&^ParamChannel, payload[channelIDSize:], id&channelFragmented != 0)
+	}
+	ch, err := mux.peerChannel(0)
+	if err != nil {
+		return err
+	}
+	return ch.receive(param, payload, false)
+}
+
+func (mux *Mux) fail(err error) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	if mux.err == nil {
+		mux.err = err
+	}
+	for _, ch := range mux.channels {
+		ch.fail(err)
+	}
+}
+
+func (mux *Mux) writeFrame(param uint8, payload []byte) error {
+	mux.writeLock.Lock()
+	defer mux.writeLock.Unlock()
+	return mux.writeFrameLocked(param, payload)
+}
+
+// writeFrameLocked writes a frame. Must be called with mux.writeLock held.
+func (mux *Mux) writeFrameLocked(param uint8, payload []byte) error {
+	if err := WriteMessage(mux.writer, param, payload); err != nil {
+		return err
+	}
+	return mux.writer.Flush()
+}
+
+// queueWindowUpdate grants the peer increment more bytes on a channel, leaving the
+// window update to be sent by sendWindowUpdates rather than by the caller. Closed
+// channels grant no more window, which would be granted to the next channel of the
+// same id.
+func (mux *Mux) queueWindowUpdate(ch *Channel, increment uint32) {
+	mux.lock.Lock()
+	ch.lock.Lock()
+	closed := ch.closed
+	ch.lock.Unlock()
+	if !closed {
+		mux.updates[ch.ID] += increment
+	}
+	mux.lock.Unlock()
+	select {
+	case mux.updateReady <- struct{}{}:
+	default:
+	}
+}
+
+// sendWindowUpdates sends queued window updates until stopped is closed. Failing to
+// send them fails the Mux.
+func (mux *Mux) sendWindowUpdates(stopped chan struct{}) {
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-mux.updateReady:
+		}
+		for {
+			sent, err := mux.sendWindowUpdate()
+			if err != nil {
+				mux.fail(err)
+				return
+			}
+			if !sent {
+				break
+			}
+		}
+	}
+}
+
+// sendWindowUpdate sends one of the queued window updates, if any. The write lock is
+// held from taking the update off the queue to sending it, so that a channel closing
+// meanwhile doesn't have it sent after its close frame.
+func (mux *Mux) sendWindowUpdate() (bool, error) {
+	mux.writeLock.Lock()
+	defer mux.writeLock.Unlock()
+	mux.lock.Lock()
+	var id uint16
+	var increment uint32
+	for id, increment = range mux.updates {
+		delete(mux.updates, id)
+		break
+	}
+	mux.lock.Unlock()
+	if increment == 0 {
+		return false, nil
+	}
+	var payload [windowUpdateSize]byte
+	binary.BigEndian.PutUint16(payload[:], id)
+	binary.BigEndian.PutUint32(payload[channelIDSize:], increment)
+	return true, mux.writeFrameLocked(ControlWindowUpdate, payload[:])
+}
+
+// ----------------------------------------------------------------------------
+// Channel
+// ----------------------------------------------------------------------------
+
+// Channel is one of the conversations multiplexed by a Mux. It is safe for
+// concurrent use.
+type Channel struct {
+	ID  uint16
+	mux *Mux
+
+	// Keeps the fragments of a message together
+	writeLock  sync.Mutex
+	compressed bytes.Buffer
+	fragment   []byte
+
+	lock  sync.Mutex
+	cond  *sync.Cond
+	queue []queuedMessage
+	err   error
+
+	// Whether the channel was closed by Close, by the peer, and whether any frame was
+	// sent or received on it
+	closed     bool
+	peerClosed bool
+	used       bool
+
+	// Message being reassembled
+	assembling    bool
+	assembly      []byte
+	assemblyParam uint8
+
+	// Flow control
+	window   int64  // bytes that may be sent
+	received uint32 // bytes received that the peer hasn't been granted again
+	consumed uint32 // bytes consumed that the peer hasn't been granted again
+}
+
+type queuedMessage struct {
+	msg    *Message
+	credit uint32
+}
+
+// WriteMessage sends a message on the channel, encoded according to the Options of
+// the Mux. It blocks while the channel's window is exhausted.
+func (ch *Channel) WriteMessage(param uint8, binaryXML []byte) error {
+	ch.writeLock.Lock()
+	defer ch.writeLock.Unlock()
+	param, payload, err := ch.mux.encode(param, binaryXML, &ch.compressed)
+	if err != nil {
+		return err
+	}
+	if ch.ID == 0 {
+		return ch.mux.writeFrame(param, payload)
+	}
+	for {
+		n, err := ch.reserve(len(payload))
+		if err != nil {
+			return err
+		}
+		id := ch.ID
+		if n < len(payload) {
+			id |= channelFragmented
+		}
+		ch.fragment = append(ch.fragment[:0], byte(id>>8), byte(id))
+		ch.fragment = append(ch.fragment, payload[:n]...)
+		if err := ch.mux.writeFrame(param|ParamChannel, ch.fragment); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			return nil
+		}
+	}
+}
+
+// Next returns the next message received on the channel, in a pooled buffer the
+// caller must Release. Consuming a message grants the peer window to send more.
+// Once the peer closed the channel, and its messages were consumed, Next returns
+// io.EOF.
+func (ch *Channel) Next() (*Message, error) {
+	ch.lock.Lock()
+	for len(ch.queue) == 0 && ch.err == nil && !ch.closed && !ch.peerClosed {
+		ch.cond.Wait()
+	}
+	if ch.closed {
+		ch.lock.Unlock()
+		return nil, ErrChannelClosed
+	}
+	if len(ch.queue) == 0 {
+		err := ch.err
+		if err == nil {
+			err = io.EOF
+		}
+		ch.lock.Unlock()
+		return nil, err
+	}
+	queued := ch.queue[0]
+	ch.queue[0] = queuedMessage{}
+	ch.queue = ch.queue[1:]
+	increment := ch.credit(queued.credit)
+	ch.lock.Unlock()
+
+	if increment > 0 {
+		ch.mux.queueWindowUpdate(ch, increment)
+	}
+	return queued.msg, nil
+}
+
+// Close closes the channel, discarding the messages it holds, and tells the peer,
+// whose Next then returns io.EOF once it has consumed what was sent. Writing on a
+// closed channel fails with ErrChannelClosed. The channel is removed from the Mux
+// once both ends closed it, or right away if it was never used, and only then does
+// Channel open a new one of the same id. Channel 0 can't be closed, and closing it
+// does nothing.
+func (ch *Channel) Close() error {
+	if ch.ID == 0 {
+		return nil
+	}
+	mux := ch.mux
+	mux.writeLock.Lock()
+	defer mux.writeLock.Unlock()
+	mux.lock.Lock()
+	ch.lock.Lock()
+	if ch.closed {
+		ch.lock.Unlock()
+		mux.lock.Unlock()
+		return nil
+	}
+	ch.closed = true
+	used := ch.used
+	for _, queued := range ch.queue {
+		queued.msg.Release()
+	}
+	ch.queue = nil
+	ch.assembling = false
+	ch.cond.Broadcast()
+	if ch.peerClosed || !used {
+		ch.remove()
+	}
+	ch.lock.Unlock()
+	delete(mux.updates, ch.ID)
+	mux.lock.Unlock()
+
+	if !used {
+		return nil
+	}
+	var payload [channelIDSize]byte
+	binary.BigEndian.PutUint16(payload[:], ch.ID)
+	return mux.writeFrameLocked(ControlChannelClose, payload[:])
+}
+
+// peerClose handles the peer closing the channel. Must be called with mux.lock held.
+func (ch *Channel) peerClose() {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.peerClosed = true
+	ch.assembling = false
+	ch.cond.Broadcast()
+	if ch.closed {
+		ch.remove()
+	}
+}
+
+// remove the channel from its Mux, unless another channel of the same id replaced
+// it. Must be called with mux.lock held.
+func (ch *Channel) remove() {
+	if ch.mux.channels[ch.ID] == ch {
+		delete(ch.mux.channels, ch.ID)
+	}
+}
+
+// reserve waits for window to send the next fragment of a message of which n bytes
+// remain, and returns the size of that fragment.
+func (ch *Channel) reserve(n int) (int, error) {
+	if n > ch.mux.FragmentSize {
+		n = ch.mux.FragmentSize
+	}
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	for n > 0 && ch.window <= 0 && ch.err == nil && !ch.closed && !ch.peerClosed {
+		ch.cond.Wait()
+	}
+	if ch.err != nil {
+		return 0, ch.err
+	}
+	if ch.closed || ch.peerClosed {
+		return 0, ErrChannelClosed
+	}
+	ch.used = true
+	if int64(n) > ch.window {
+		n = int(ch.window)
+	}
+	ch.window -= int64(n)
+	return n, nil
+}
+
+func (ch *Channel) grant(increment uint32) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.window += int64(increment)
+	ch.cond.Broadcast()
+}
+
+// receive handles a fragment received on the channel. The fragments of a message
+// being reassembled are granted back to the peer right away, so that messages larger
+// than the window get through, while the last fragment is only granted back once
+// the message has been consumed. On channel 0, which has no window, receive instead
+// waits for messages to be consumed while ChannelWindow bytes are queued.
+func (ch *Channel) receive(param uint8, chunk []byte, more bool) error {
+	ch.lock.Lock()
+	if ch.closed {
+		// Sent before the peer knew of the close
+		ch.lock.Unlock()
+		return nil
+	}
+	if ch.peerClosed {
+		ch.lock.Unlock()
+		return &FrameError{Msg: fmt.Sprintf("channel %d used after closing it", ch.ID)}
+	}
+	ch.used = true
+	if ch.ID == 0 {
+		for ch.received >= ch.mux.ChannelWindow && ch.err == nil {
+			ch.cond.Wait()
+		}
+		if ch.err != nil {
+			err := ch.err
+			ch.lock.Unlock()
+			return err
+		}
+	}
+	ch.received += uint32(len(chunk))
+	if ch.ID != 0 && ch.received > ch.mux.ChannelWindow {
+		ch.lock.Unlock()
+		return &FrameError{Msg: fmt.Sprintf("channel %d window exceeded", ch.ID)}
+	}
+
+	// Reassemble fragmented messages
+	payload := chunk
+	if more || ch.assembling {
+		if !ch.assembling {
+			ch.assembling = true
+			ch.assemblyParam = param
+			ch.assembly = ch.assembly[:0]
+		}
+		if len(ch.assembly)+len(chunk) > int(ch.mux.MaxMessageSize) {
+			ch.lock.Unlock()
+			return &TooLongError{Max: ch.mux.MaxMessageSize}
+		}
+		ch.assembly = append(ch.assembly, chunk...)
+		if more {
+			increment := ch.credit(uint32(len(chunk)))
+			ch.lock.Unlock()
+			if increment > 0 {
+				ch.mux.queueWindowUpdate(ch, increment)
+			}
+			return nil
+		}
+		ch.assembling = false
+		param = ch.assemblyParam
+		payload = ch.assembly
+	}
+
+	msg := messagePool.Get().(*Message)
+	msg.Param = param
+	if compression := ParamCompression(param); compression != CompressionNone {
+		decompressed, err := decompress(compression, payload, msg.BinaryXML, ch.mux.MaxMessageSize)
+		msg.BinaryXML = decompressed
+		if err != nil {
+			ch.lock.Unlock()
+			msg.Release()
+			return err
+		}
+	} else {
+		msg.BinaryXML = append(msg.BinaryXML[:0], payload...)
+	}
+	ch.queue = append(ch.queue, queuedMessage{msg: msg, credit: uint32(len(chunk))})
+	ch.cond.Broadcast()
+	ch.lock.Unlock()
+	return nil
+}
+
+// credit accounts for n consumed bytes, and returns the window increment to grant
+// the peer, if enough bytes were consumed to be worth a window update. Must be
+// called with ch.lock held.
+func (ch *Channel) credit(n uint32) uint32 {
+	if ch.ID == 0 {
+		// Let Run read on
+		ch.received -= n
+		ch.cond.Broadcast()
+		return 0
+	}
+	ch.consumed += n
+	if ch.consumed < ch.mux.ChannelWindow/4 {
+		return 0
+	}
+	increment := ch.consumed
+	ch.consumed = 0
+	ch.received -= increment
+	return increment
+}
+
+func (ch *Channel) fail(err error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if ch.err == nil {
+		ch.err = err
+	}
+	ch.cond.Broadcast()
+}
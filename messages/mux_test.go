@@ -0,0 +1,272 @@
+package messages_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+// muxPair connects two muxes, configured by configure before they start running
+func muxPair(t *testing.T, configure func(*messages.Mux)) (*messages.Mux, *messages.Mux, func()) {
+	left, right := net.Pipe()
+	a, b := messages.NewMux(left), messages.NewMux(right)
+	if configure != nil {
+		configure(a)
+		configure(b)
+	}
+	go a.Run()
+	go b.Run()
+	return a, b, func() {
+		left.Close()
+		right.Close()
+	}
+}
+
+func TestMuxChannels(t *testing.T) {
+	assert := assert.New(t)
+	a, b, closePair := muxPair(t, func(mux *messages.Mux) {
+		mux.FragmentSize = 1000
+	})
+	defer closePair()
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	sent := make(chan error, 2)
+	go func() { sent <- a.Channel(1).WriteMessage(messages.ParamMore, large) }()
+	go func() { sent <- a.Channel(2).WriteMessage(0, []byte("small")) }()
+
+	msg, err := b.Channel(2).Next()
+	assert.NoError(err)
+	assert.Equal("small", string(msg.BinaryXML))
+	msg.Release()
+
+	msg, err = b.Channel(1).Next()
+	assert.NoError(err)
+	assert.Equal(messages.ParamMore, msg.Param)
+	assert.Equal(large, msg.BinaryXML)
+	msg.Release()
+
+	assert.NoError(<-sent)
+	assert.NoError(<-sent)
+}
+
+func TestMuxCompression(t *testing.T) {
+	assert := assert.New(t)
+	a, b, closePair := muxPair(t, func(mux *messages.Mux) {
+		mux.FragmentSize = 100
+	})
+	defer closePair()
+
+	payload := bytes.Repeat([]byte("<metric>Common_CPU</metric>"), 1000)
+	for _, compression := range compressions {
+		a.Compression = compression
+		go a.Channel(1).WriteMessage(0, payload)
+
+		msg, err := b.Channel(1).Next()
+		assert.NoError(err, compression.String())
+		assert.Equal(compression, messages.ParamCompression(msg.Param), compression.String())
+		assert.Equal(payload, msg.BinaryXML, compression.String())
+		msg.Release()
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	assert := assert.New(t)
+	a, b, closePair := muxPair(t, func(mux *messages.Mux) {
+		mux.ChannelWindow = 100
+	})
+	defer closePair()
+
+	// The first message fills the window, so the second one blocks until the first
+	// one is consumed
+	payload := bytes.Repeat([]byte("x"), 100)
+	assert.NoError(a.Channel(1).WriteMessage(0, payload))
+	sent := make(chan error, 1)
+	go func() { sent <- a.Channel(1).WriteMessage(0, payload) }()
+	select {
+	case err := <-sent:
+		assert.Fail("Message sent beyond the channel window", "%v", err)
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Other channels aren't held up
+	assert.NoError(a.Channel(2).WriteMessage(0, []byte("other")))
+	msg, err := b.Channel(2).Next()
+	assert.NoError(err)
+	assert.Equal("other", string(msg.BinaryXML))
+	msg.Release()
+
+	// Consuming the first message lets the second one through
+	for i := 0; i < 2; i++ {
+		msg, err := b.Channel(1).Next()
+		assert.NoError(err)
+		assert.Equal(payload, msg.BinaryXML)
+		msg.Release()
+	}
+	assert.NoError(<-sent)
+}
+
+func TestMuxPlainMessages(t *testing.T) {
+	assert := assert.New(t)
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	mux := messages.NewMux(left)
+	go mux.Run()
+
+	// Channel 0 exchanges plain messages with peers that don't multiplex
+	go messages.WriteMessage(right, messages.ParamResponse, []byte("from plain peer"))
+	msg, err := mux.Channel(0).Next()
+	assert.NoError(err)
+	assert.Equal(messages.ParamResponse, msg.Param)
+	assert.Equal("from plain peer", string(msg.BinaryXML))
+	msg.Release()
+
+	go mux.Channel(0).WriteMessage(messages.ParamMore, []byte("from mux"))
+	var param uint8
+	var binaryXML []byte
+	assert.NoError(messages.ReadMessage(right, &param, &binaryXML))
+	assert.Equal(messages.ParamMore, param)
+	assert.Equal("from mux", string(binaryXML))
+}
+
+func TestMuxWindowExceeded(t *testing.T) {
+	assert := assert.New(t)
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	mux := messages.NewMux(left)
+	mux.ChannelWindow = 10
+	failed := make(chan error, 1)
+	go func() { failed <- mux.Run() }()
+
+	// A peer ignoring the window
+	payload := make([]byte, 2+20)
+	binary.BigEndian.PutUint16(payload, 1)
+	go messages.WriteMessage(right, messages.ParamChannel, payload)
+
+	err := <-failed
+	assert.EqualError(err, "Malformed message; channel 1 window exceeded")
+	msg, nextErr := mux.Channel(1).Next()
+	assert.Nil(msg)
+	assert.Equal(err, nextErr)
+}
+
+func TestMuxPlainFlowControl(t *testing.T) {
+	assert := assert.New(t)
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	mux := messages.NewMux(left)
+	mux.ChannelWindow = 10
+	go mux.Run()
+
+	// Reading stops while a window's worth of plain messages waits to be consumed
+	payload := bytes.Repeat([]byte("x"), 10)
+	written := make(chan int, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := messages.WriteMessage(right, 0, payload); err != nil {
+				return
+			}
+			written <- i
+		}
+	}()
+	assert.Equal(0, <-written)
+	assert.Equal(1, <-written)
+	select {
+	case <-written:
+		assert.Fail("Message read beyond the channel window")
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Consuming a message lets reading go on
+	msg, err := mux.Channel(0).Next()
+	assert.NoError(err)
+	msg.Release()
+	select {
+	case i := <-written:
+		assert.Equal(2, i)
+	case <-time.After(time.Second):
+		assert.Fail("Reading did not resume")
+	}
+}
+
+func TestMuxMaxChannels(t *testing.T) {
+	assert := assert.New(t)
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	mux := messages.NewMux(left)
+	mux.MaxChannels = 2
+	failed := make(chan error, 1)
+	go func() { failed <- mux.Run() }()
+
+	// A peer opening more channels than allowed
+	go func() {
+		for id := uint16(1); id <= 3; id++ {
+			payload := make([]byte, 2+5)
+			binary.BigEndian.PutUint16(payload, id)
+			if err := messages.WriteMessage(right, messages.ParamChannel, payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := <-failed
+	assert.EqualError(err, "Malformed message; channel 3 exceeds the 2 open channels allowed")
+	msg, nextErr := mux.Channel(1).Next()
+	assert.NoError(nextErr)
+	msg.Release()
+}
+
+// Channels closed by both ends free their slot, so that a connection may go through
+// more channels than it has open at once, and reuse their ids
+func TestMuxChannelClose(t *testing.T) {
+	assert := assert.New(t)
+	a, b, closePair := muxPair(t, func(mux *messages.Mux) {
+		mux.MaxChannels = 2
+		mux.ChannelWindow = 100
+	})
+	defer closePair()
+
+	payload := bytes.Repeat([]byte("x"), 60)
+	for i := 0; i < 10; i++ {
+		id := uint16(1 + i%5)
+		assert.NoError(a.Channel(id).WriteMessage(0, payload))
+		request := b.Channel(id)
+		msg, err := request.Next()
+		if !assert.NoError(err) {
+			return
+		}
+		msg.Release()
+		assert.NoError(request.WriteMessage(0, payload))
+		msg, err = a.Channel(id).Next()
+		if !assert.NoError(err) {
+			return
+		}
+		msg.Release()
+
+		// The peer's Next ends with its channel
+		assert.NoError(a.Channel(id).Close())
+		msg, err = request.Next()
+		assert.Nil(msg)
+		assert.Equal(io.EOF, err)
+		assert.Equal(messages.ErrChannelClosed, request.WriteMessage(0, payload))
+		assert.NoError(request.Close())
+	}
+
+	// Closed channels fail
+	ch := a.Channel(1)
+	assert.NoError(ch.Close())
+	assert.Equal(messages.ErrChannelClosed, ch.WriteMessage(0, payload))
+	_, err := ch.Next()
+	assert.Equal(messages.ErrChannelClosed, err)
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package messages_test
+
+// The race detector makes sync.Pool drop items at random
+const raceEnabled = true
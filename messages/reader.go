@@ -0,0 +1,319 @@
+package messages
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// DefaultMaxMessageSize is the largest payload accepted by ReadMessage
+const DefaultMaxMessageSize uint32 = 2e6
+
+const (
+	headerSize  = 6 // start token, length, param
+	trailerSize = 5 // end token, checksum
+
+	// Payload buffers grow in steps of at least this size as content arrives
+	minReadChunk = 4096
+)
+
+// ----------------------------------------------------------------------------
+// Reader
+// ----------------------------------------------------------------------------
+
+// Reader reads messages from an underlying reader.
+type Reader struct {
+	// Largest payload ReadMessage accepts. Longer messages are rejected before any of
+	// their payload is read.
+	MaxMessageSize uint32
+
+	// When set, ReadMessage skips corrupted frames instead of failing, scanning forward
+	// for the next start token that begins a frame whose length, end token and checksum
+	// all validate. ReadMessageStream is unavailable in this mode, since a payload can
+	// only be trusted once it has been read whole.
+	Resync bool
+
+	// Called with the number of bytes discarded whenever resynchronizing skipped data
+	OnSkip func(skipped int)
+
+	reader     io.Reader
+	scratch    [headerSize]byte
+	stream     *PayloadReader
+	compressed []byte
+
+	// Bytes read ahead while resynchronizing, consumed before the underlying reader
+	buffer  []byte
+	pending []byte
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{MaxMessageSize: DefaultMaxMessageSize, reader: reader}
+}
+
+// ReadMessage reads the next message into binaryXML. The slice binaryXML points to
+// is reused when its capacity allows, so callers can recycle payload buffers across
+// messages. Otherwise the payload is accumulated as it arrives, rather than
+// allocated up front from the length announced by the peer. Compressed payloads are
+// decompressed, and param keeps the compression bits they were sent with. Frames
+// flagged with ParamChannel are returned as they are, use a Mux to reassemble them.
+func (reader *Reader) ReadMessage(param *uint8, binaryXML *[]byte) error {
+	// Read compressed payloads aside for decompression
+	if err := reader.readFrame(param, binaryXML, &reader.compressed); err != nil {
+		return err
+	}
+	if compression := ParamCompression(*param); compression != CompressionNone {
+		decompressed, err := decompress(compression, reader.compressed, *binaryXML, reader.MaxMessageSize)
+		*binaryXML = decompressed
+		return err
+	}
+	return nil
+}
+
+// readFrame reads and verifies the next frame, without decoding its payload. The
+// payload is read into plain, or into compressed when param flags it as compressed.
+func (reader *Reader) readFrame(param *uint8, plain *[]byte, compressed *[]byte) error {
+	if reader.Resync {
+		return reader.readResync(param, plain, compressed)
+	}
+	length, err := reader.readHeader(param)
+	if err != nil {
+		return err
+	}
+	if length > reader.MaxMessageSize {
+		return &TooLongError{Length: length, Max: reader.MaxMessageSize}
+	}
+
+	// Read message
+	buffer := plain
+	if ParamCompression(*param) != CompressionNone {
+		buffer = compressed
+	}
+	payload, err := readPayload(pendingInput{reader}, length, (*buffer)[:0])
+	*buffer = payload
+	if err != nil {
+		return err
+	}
+
+	// Read message end token and checksum
+	crcFromPayload, err := reader.readTrailer()
+	if err != nil {
+		return err
+	}
+
+	// Compute our own checksum for the message, and reject message whose checksum doesn't match
+	checksum := ParamChecksum(*param)
+	return checksum.verify(checksum.sum(payload), crcFromPayload)
+}
+
+// ReadMessageStream reads the header of the next message, and returns its payload
+// as a reader, decompressing it as it is read. The payload is not subject to
+// MaxMessageSize, since it is never held in memory by the Reader. Reading the next
+// message discards whatever remains unread of the payload.
+func (reader *Reader) ReadMessageStream(param *uint8) (*PayloadReader, error) {
+	if reader.Resync {
+		return nil, errors.New("ReadMessageStream is not supported in resync mode")
+	}
+	length, err := reader.readHeader(param)
+	if err != nil {
+		return nil, err
+	}
+	reader.stream = &PayloadReader{
+		reader:      reader,
+		remaining:   length,
+		checksum:    ParamChecksum(*param),
+		hash:        ParamChecksum(*param).newHash(),
+		compression: ParamCompression(*param),
+	}
+	return reader.stream, nil
+}
+
+func (reader *Reader) readHeader(param *uint8) (uint32, error) {
+	if err := reader.discardStream(); err != nil {
+		return 0, err
+	}
+
+	// Read message start token
+	header := reader.scratch[:]
+	if _, err := io.ReadFull(pendingInput{reader}, header[:1]); err != nil {
+		return 0, err
+	}
+	if header[0] != msgstate_start {
+		return 0, &FrameError{Msg: "missing start token"}
+	}
+
+	// Read message length and param
+	if _, err := io.ReadFull(pendingInput{reader}, header[1:]); err != nil {
+		return 0, unexpected(err)
+	}
+	*param = header[5]
+	return binary.BigEndian.Uint32(header[1:5]), nil
+}
+
+// Discard remainder of a previous streamed payload
+func (reader *Reader) discardStream() error {
+	stream := reader.stream
+	if stream == nil {
+		return nil
+	}
+	reader.stream = nil
+	if stream.decompressor != nil {
+		stream.decompressor.Close()
+	}
+	_, err := io.Copy(ioutil.Discard, rawPayload{stream})
+	return err
+}
+
+func (reader *Reader) readTrailer() (uint32, error) {
+	trailer := reader.scratch[:trailerSize]
+	if _, err := io.ReadFull(pendingInput{reader}, trailer); err != nil {
+		return 0, unexpected(err)
+	}
+	if trailer[0] != msgstate_end {
+		return 0, &FrameError{Msg: "missing end token"}
+	}
+	return binary.BigEndian.Uint32(trailer[1:]), nil
+}
+
+func readPayload(reader io.Reader, length uint32, buffer []byte) ([]byte, error) {
+	for remaining := int(length); remaining > 0; {
+		if len(buffer) == cap(buffer) {
+			grow := cap(buffer)
+			if grow < minReadChunk {
+				grow = minReadChunk
+			}
+			if grow > remaining {
+				grow = remaining
+			}
+			grown := make([]byte, len(buffer), len(buffer)+grow)
+			copy(grown, buffer)
+			buffer = grown
+		}
+		chunk := cap(buffer) - len(buffer)
+		if chunk > remaining {
+			chunk = remaining
+		}
+		n, err := io.ReadFull(reader, buffer[len(buffer):len(buffer)+chunk])
+		buffer = buffer[:len(buffer)+n]
+		if err != nil {
+			return buffer, unexpected(err)
+		}
+		remaining -= n
+	}
+	return buffer, nil
+}
+
+// A message cut short is never a clean end of stream
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ----------------------------------------------------------------------------
+// Streamed payload
+// ----------------------------------------------------------------------------
+
+// PayloadReader reads the payload of a single message. Once the payload has been
+// read, the message trailer is consumed and the checksum verified, so that Read
+// only returns io.EOF for an intact message.
+type PayloadReader struct {
+	reader    *Reader
+	remaining uint32
+	checksum  Checksum
+	hash      hash.Hash32
+	err       error
+
+	compression     Compression
+	decompressor    io.ReadCloser
+	decompressorErr error
+}
+
+// Len returns the number of payload bytes not yet read from the underlying reader.
+// For a compressed payload, these are compressed bytes.
+func (payload *PayloadReader) Len() int {
+	return int(payload.remaining)
+}
+
+func (payload *PayloadReader) Read(p []byte) (int, error) {
+	if payload.compression == CompressionNone {
+		return payload.readRaw(p)
+	}
+	if payload.decompressorErr != nil {
+		return 0, payload.decompressorErr
+	}
+	if payload.decompressor == nil {
+		decompressor, err := newDecompressor(payload.compression, rawPayload{payload})
+		if err != nil {
+			payload.decompressorErr = err
+			return 0, err
+		}
+		payload.decompressor = decompressor
+	}
+	n, err := payload.decompressor.Read(p)
+	if err == io.EOF {
+		// Read up to the trailer, so that the checksum is verified
+		if _, rawErr := io.Copy(ioutil.Discard, rawPayload{payload}); rawErr != nil {
+			err = rawErr
+		}
+	}
+	if err != nil {
+		payload.decompressorErr = err
+	}
+	return n, err
+}
+
+// rawPayload reads the payload as sent, without decompressing it.
+type rawPayload struct {
+	*PayloadReader
+}
+
+func (raw rawPayload) Read(p []byte) (int, error) {
+	return raw.readRaw(p)
+}
+
+func (payload *PayloadReader) readRaw(p []byte) (int, error) {
+	if payload.err != nil {
+		return 0, payload.err
+	}
+	if payload.remaining == 0 {
+		payload.err = payload.verify()
+		return 0, payload.err
+	}
+	if uint32(len(p)) > payload.remaining {
+		p = p[:payload.remaining]
+	}
+	n, err := pendingInput{payload.reader}.Read(p)
+	if payload.hash != nil {
+		payload.hash.Write(p[:n])
+	}
+	payload.remaining -= uint32(n)
+	if err == io.EOF {
+		if payload.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		payload.err = err
+	}
+	return n, err
+}
+
+func (payload *PayloadReader) verify() error {
+	crcFromPayload, err := payload.reader.readTrailer()
+	if err != nil {
+		return err
+	}
+	var computed uint32
+	if payload.hash != nil {
+		computed = payload.hash.Sum32()
+	}
+	if err := payload.checksum.verify(computed, crcFromPayload); err != nil {
+		return err
+	}
+	return io.EOF
+}
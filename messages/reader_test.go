@@ -0,0 +1,145 @@
+package messages_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func frame(t *testing.T, param uint8, payload []byte) []byte {
+	var buffer bytes.Buffer
+	assert.NoError(t, messages.WriteMessage(&buffer, param, payload))
+	return buffer.Bytes()
+}
+
+func TestReaderReadMessage(t *testing.T) {
+	assert := assert.New(t)
+	data := append(frame(t, 1, []byte("first")), frame(t, 2, []byte("second"))...)
+	reader := messages.NewReader(bytes.NewReader(data))
+
+	// Payload buffer is reused when large enough
+	var param uint8
+	binaryXML := make([]byte, 0, 16)
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal(uint8(1), param)
+	assert.Equal("first", string(binaryXML))
+	buffer := binaryXML
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal(uint8(2), param)
+	assert.Equal("second", string(binaryXML))
+	assert.Equal(&buffer[:1][0], &binaryXML[0])
+
+	assert.Equal(io.EOF, reader.ReadMessage(&param, &binaryXML))
+}
+
+func TestReadMessageAllocates(t *testing.T) {
+	assert := assert.New(t)
+	data := append(frame(t, 1, []byte("first")), frame(t, 2, []byte("second"))...)
+	input := bytes.NewReader(data)
+
+	// Payloads are never written into the caller's buffer
+	var param uint8
+	binaryXML := make([]byte, 0, 16)
+	buffer := binaryXML
+	assert.NoError(messages.ReadMessage(input, &param, &binaryXML))
+	assert.Equal("first", string(binaryXML))
+	assert.Equal(make([]byte, 5), buffer[:5])
+	first := binaryXML
+	assert.NoError(messages.ReadMessage(input, &param, &binaryXML))
+	assert.Equal("second", string(binaryXML))
+	assert.Equal("first", string(first))
+	assert.NotEqual(&buffer[:1][0], &binaryXML[0])
+}
+
+func TestReaderMaxMessageSize(t *testing.T) {
+	assert := assert.New(t)
+	payload := bytes.Repeat([]byte("x"), 100)
+	data := frame(t, 0, payload)
+
+	// Only the header is available, so rejection must happen before reading the payload
+	reader := messages.NewReader(bytes.NewReader(data[:6]))
+	reader.MaxMessageSize = 99
+	var param uint8
+	var binaryXML []byte
+	assert.EqualError(reader.ReadMessage(&param, &binaryXML), "message length too long - 100")
+
+	reader = messages.NewReader(bytes.NewReader(data))
+	reader.MaxMessageSize = 100
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal(payload, binaryXML)
+}
+
+func TestReaderTruncatedMessage(t *testing.T) {
+	assert := assert.New(t)
+	data := frame(t, 0, bytes.Repeat([]byte("x"), 10000))
+
+	// A peer announcing a large payload and then hanging up doesn't cause its allocation
+	reader := messages.NewReader(bytes.NewReader(data[:100]))
+	var param uint8
+	var binaryXML []byte
+	assert.Equal(io.ErrUnexpectedEOF, reader.ReadMessage(&param, &binaryXML))
+	assert.True(cap(binaryXML) < 10000)
+}
+
+func TestReaderChecksum(t *testing.T) {
+	assert := assert.New(t)
+	data := frame(t, 0, []byte("payload"))
+	data[len(data)-1]++
+	var param uint8
+	var binaryXML []byte
+	assert.Error(messages.ReadMessage(bytes.NewReader(data), &param, &binaryXML))
+}
+
+func TestReaderReadMessageStream(t *testing.T) {
+	assert := assert.New(t)
+	payload := bytes.Repeat([]byte("snapshot"), 1e6)
+	data := append(frame(t, 3, payload), frame(t, 1, []byte("next"))...)
+	reader := messages.NewReader(bytes.NewReader(data))
+
+	// Larger than MaxMessageSize
+	var param uint8
+	stream, err := reader.ReadMessageStream(&param)
+	assert.NoError(err)
+	assert.Equal(uint8(3), param)
+	assert.Equal(len(payload), stream.Len())
+	streamed, err := ioutil.ReadAll(stream)
+	assert.NoError(err)
+	assert.Equal(payload, streamed)
+
+	// Next message follows
+	var binaryXML []byte
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal("next", string(binaryXML))
+}
+
+func TestReaderReadMessageStreamChecksum(t *testing.T) {
+	assert := assert.New(t)
+	data := frame(t, 0, []byte("payload"))
+	data[8]++
+	reader := messages.NewReader(bytes.NewReader(data))
+	var param uint8
+	stream, err := reader.ReadMessageStream(&param)
+	assert.NoError(err)
+	_, err = ioutil.ReadAll(stream)
+	assert.EqualError(err, "Malformed message; crc32 checksum does not match")
+}
+
+func TestReaderReadMessageStreamDiscard(t *testing.T) {
+	assert := assert.New(t)
+	data := append(frame(t, 0, []byte("unread payload")), frame(t, 0, []byte("next"))...)
+	reader := messages.NewReader(bytes.NewReader(data))
+	var param uint8
+	stream, err := reader.ReadMessageStream(&param)
+	assert.NoError(err)
+	buffer := make([]byte, 6)
+	_, err = io.ReadFull(stream, buffer)
+	assert.NoError(err)
+
+	var binaryXML []byte
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal("next", string(binaryXML))
+}
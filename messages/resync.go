@@ -0,0 +1,132 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// ----------------------------------------------------------------------------
+// Resynchronization
+// ----------------------------------------------------------------------------
+
+// readResync reads the next intact frame as readFrame does, skipping any bytes that
+// don't belong to one. A candidate frame is only accepted once it has been read
+// whole, so a corrupted length can hold up the read until that many bytes have
+// arrived, up to MaxMessageSize.
+func (reader *Reader) readResync(param *uint8, plain *[]byte, compressed *[]byte) error {
+	if err := reader.discardStream(); err != nil {
+		return err
+	}
+	skipped := 0
+	defer func() {
+		if skipped > 0 && reader.OnSkip != nil {
+			reader.OnSkip(skipped)
+		}
+	}()
+	for {
+		// Drop everything preceding the next start token
+		if err := reader.fill(1); err != nil {
+			if err == io.EOF && skipped > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		start := bytes.IndexByte(reader.pending, msgstate_start)
+		if start < 0 {
+			skipped += len(reader.pending)
+			reader.pending = reader.pending[:0]
+			continue
+		}
+		skipped += start
+		reader.pending = reader.pending[start:]
+
+		// Validate the candidate frame, moving past its start token if it doesn't hold up
+		frameSize, err := reader.candidate()
+		if err != nil {
+			return err
+		}
+		if frameSize == 0 {
+			skipped++
+			reader.pending = reader.pending[1:]
+			continue
+		}
+
+		frame := reader.pending[:frameSize]
+		reader.pending = reader.pending[frameSize:]
+		*param = frame[5]
+		buffer := plain
+		if ParamCompression(*param) != CompressionNone {
+			buffer = compressed
+		}
+		*buffer = append((*buffer)[:0], frame[headerSize:frameSize-trailerSize]...)
+		return nil
+	}
+}
+
+// candidate returns the size of the frame starting at the first pending byte, or 0
+// when the bytes there aren't a valid frame. Only errors other than io.EOF are
+// returned, since a frame cut short by the end of input is just another invalid
+// one.
+func (reader *Reader) candidate() (int, error) {
+	if err := reader.fill(headerSize); err != nil {
+		return 0, ignoreEOF(err)
+	}
+	length := binary.BigEndian.Uint32(reader.pending[1:5])
+	if length > reader.MaxMessageSize {
+		return 0, nil
+	}
+	frameSize := headerSize + int(length) + trailerSize
+	if err := reader.fill(frameSize); err != nil {
+		return 0, ignoreEOF(err)
+	}
+	payload := reader.pending[headerSize : headerSize+int(length)]
+	trailer := reader.pending[headerSize+int(length) : frameSize]
+	checksum := ParamChecksum(reader.pending[5])
+	if trailer[0] != msgstate_end || checksum.verify(checksum.sum(payload), binary.BigEndian.Uint32(trailer[1:])) != nil {
+		return 0, nil
+	}
+	return frameSize, nil
+}
+
+// fill reads ahead from the underlying reader until at least n bytes are pending.
+func (reader *Reader) fill(n int) error {
+	for len(reader.pending) < n {
+		if cap(reader.pending)-len(reader.pending) < minReadChunk {
+			// Move pending bytes to the front of the buffer, growing it if needed
+			if size := 2*len(reader.pending) + minReadChunk; cap(reader.buffer) < size {
+				reader.buffer = make([]byte, size)
+			}
+			reader.buffer = reader.buffer[:cap(reader.buffer)]
+			reader.pending = reader.buffer[:copy(reader.buffer, reader.pending)]
+		}
+		read, err := reader.reader.Read(reader.pending[len(reader.pending):cap(reader.pending)])
+		reader.pending = reader.pending[:len(reader.pending)+read]
+		if err != nil && len(reader.pending) < n {
+			return err
+		}
+	}
+	return nil
+}
+
+func ignoreEOF(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// pendingInput reads bytes left over from resynchronizing before those of the
+// underlying reader, so that the Resync mode can be switched off between messages.
+type pendingInput struct {
+	*Reader
+}
+
+func (input pendingInput) Read(p []byte) (int, error) {
+	if len(input.pending) == 0 {
+		return input.reader.Read(p)
+	}
+	n := copy(p, input.pending)
+	input.pending = input.pending[n:]
+	return n, nil
+}
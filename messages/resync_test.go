@@ -0,0 +1,87 @@
+package messages_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderResync(t *testing.T) {
+	assert := assert.New(t)
+
+	badCRC := frame(t, 0, []byte("corrupted"))
+	badCRC[len(badCRC)-1]++
+	badEnd := frame(t, 0, []byte("truncated"))
+	badEnd[len(badEnd)-5] = 0
+	var data []byte
+	data = append(data, "noise"...)
+	data = append(data, frame(t, 1, []byte("first"))...)
+	data = append(data, badCRC...)
+	data = append(data, badEnd...)
+	data = append(data, frame(t, 2, []byte("second"))...)
+
+	var skips []int
+	reader := messages.NewReader(bytes.NewReader(data))
+	reader.Resync = true
+	reader.OnSkip = func(skipped int) { skips = append(skips, skipped) }
+
+	var param uint8
+	var binaryXML []byte
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal(uint8(1), param)
+	assert.Equal("first", string(binaryXML))
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal(uint8(2), param)
+	assert.Equal("second", string(binaryXML))
+	assert.Equal(io.EOF, reader.ReadMessage(&param, &binaryXML))
+	assert.Equal([]int{len("noise"), len(badCRC) + len(badEnd)}, skips)
+}
+
+func TestReaderResyncLength(t *testing.T) {
+	assert := assert.New(t)
+
+	// Start token followed by a length past the limit, then by an incomplete frame
+	data := []byte{121, 0xff, 0xff, 0xff, 0xff, 0}
+	data = append(data, frame(t, 3, []byte("intact"))...)
+	data = append(data, frame(t, 0, []byte("cut short"))[:10]...)
+
+	skipped := 0
+	reader := messages.NewReader(bytes.NewReader(data))
+	reader.Resync = true
+	reader.OnSkip = func(n int) { skipped += n }
+
+	var param uint8
+	var binaryXML []byte
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal("intact", string(binaryXML))
+	assert.Equal(6, skipped)
+	assert.Equal(io.ErrUnexpectedEOF, reader.ReadMessage(&param, &binaryXML))
+	assert.Equal(16, skipped)
+
+	_, err := reader.ReadMessageStream(&param)
+	assert.Error(err)
+}
+
+func TestReaderResyncDisabled(t *testing.T) {
+	assert := assert.New(t)
+	data := append([]byte("x"), frame(t, 1, []byte("first"))...)
+	data = append(data, frame(t, 2, []byte("second"))...)
+	reader := messages.NewReader(bytes.NewReader(data))
+	reader.Resync = true
+
+	// Bytes read ahead while resynchronizing are not lost when switching back
+	var param uint8
+	var binaryXML []byte
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal("first", string(binaryXML))
+	reader.Resync = false
+	assert.NoError(reader.ReadMessage(&param, &binaryXML))
+	assert.Equal("second", string(binaryXML))
+
+	// Without resync, a corrupted frame fails the read
+	reader = messages.NewReader(bytes.NewReader(data))
+	assert.Error(reader.ReadMessage(&param, &binaryXML))
+}
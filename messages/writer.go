@@ -0,0 +1,104 @@
+package messages
+
+import (
+	"bytes"
+	"io"
+)
+
+// DefaultCompressionThreshold is the smallest payload a Writer compresses
+const DefaultCompressionThreshold = 1024
+
+// ----------------------------------------------------------------------------
+// Frame options
+// ----------------------------------------------------------------------------
+
+// Options configures how writers encode frames. Readers decode whatever options a
+// frame was encoded with, as flagged in its param byte.
+type Options struct {
+	// Algorithm of the frame checksum. Peers that predate checksum selection only
+	// understand ChecksumCRC32.
+	Checksum Checksum
+
+	// Algorithm payloads are compressed with
+	Compression Compression
+
+	// Payloads shorter than this are sent uncompressed
+	CompressionThreshold int
+}
+
+func NewOptions() Options {
+	return Options{CompressionThreshold: DefaultCompressionThreshold}
+}
+
+// HelloParams returns the Params of a hello advertising options: the param bits
+// understood, with the compression and checksum bits set to the one algorithm of
+// each the peer may use. Peers don't compress at all when it is CompressionNone, and
+// otherwise fall back to ChecksumCRC32.
+func (options Options) HelloParams() uint8 {
+	return SupportedParams&^(ParamCompressionMask|ParamChecksumMask) | options.Compression.Param() | options.Checksum.Param()
+}
+
+// HelloChecksum returns the checksum advertised by the Params of a hello, the only
+// one its sender accepts besides ChecksumCRC32.
+func HelloChecksum(params uint8) Checksum {
+	return ParamChecksum(params &^ ParamControl)
+}
+
+// HelloCompression returns the compression advertised by the Params of a hello,
+// the only one its sender accepts besides CompressionNone.
+func HelloCompression(params uint8) Compression {
+	return ParamCompression(params &^ ParamControl)
+}
+
+// encode returns the param and payload to send for binaryXML. Payloads are
+// compressed when they reach CompressionThreshold, unless compression doesn't make
+// them any smaller or param already carries compression bits. The checksum is only
+// flagged when param doesn't already carry checksum bits. A compressed payload is
+// held in buffer, and only valid until its next use. Control frames are sent as
+// they are.
+func (options Options) encode(param uint8, binaryXML []byte, buffer *bytes.Buffer) (uint8, []byte, error) {
+	if param&ParamControl != 0 {
+		return param, binaryXML, nil
+	}
+	if ParamChecksum(param) == ChecksumCRC32 {
+		param |= options.Checksum.Param()
+	}
+	if options.Compression == CompressionNone || len(binaryXML) < options.CompressionThreshold || ParamCompression(param) != CompressionNone {
+		return param, binaryXML, nil
+	}
+	buffer.Reset()
+	if err := compress(options.Compression, binaryXML, buffer); err != nil {
+		return param, nil, err
+	}
+	if buffer.Len() >= len(binaryXML) {
+		return param, binaryXML, nil
+	}
+	return param | options.Compression.Param(), buffer.Bytes(), nil
+}
+
+// ----------------------------------------------------------------------------
+// Writer
+// ----------------------------------------------------------------------------
+
+// Writer writes messages to an underlying writer, encoding them according to its
+// Options.
+type Writer struct {
+	Options
+
+	writer io.Writer
+	buffer bytes.Buffer
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{Options: NewOptions(), writer: writer}
+}
+
+// WriteMessage writes a message, flagging the checksum and any compression of its
+// payload in param.
+func (writer *Writer) WriteMessage(param uint8, binaryXML []byte) error {
+	param, binaryXML, err := writer.encode(param, binaryXML, &writer.buffer)
+	if err != nil {
+		return err
+	}
+	return WriteMessage(writer.writer, param, binaryXML)
+}
@@ -0,0 +1,97 @@
+package messages_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+var compressions = []messages.Compression{messages.CompressionGzip, messages.CompressionZstd, messages.CompressionSnappy}
+
+func TestWriterCompression(t *testing.T) {
+	assert := assert.New(t)
+	payload := bytes.Repeat([]byte("<metric>Common_CPU</metric>"), 1000)
+
+	for _, compression := range compressions {
+		var buffer bytes.Buffer
+		writer := messages.NewWriter(&buffer)
+		writer.Compression = compression
+		assert.NoError(writer.WriteMessage(messages.ParamResponse, payload))
+		assert.True(buffer.Len() < len(payload)/10, compression.String())
+
+		// Decompressed by ReadMessage
+		var param uint8
+		var binaryXML []byte
+		reader := messages.NewReader(bytes.NewReader(buffer.Bytes()))
+		assert.NoError(reader.ReadMessage(&param, &binaryXML))
+		assert.Equal(messages.ParamResponse|compression.Param(), param)
+		assert.Equal(compression, messages.ParamCompression(param))
+		assert.Equal(payload, binaryXML)
+
+		// Decompressed by ReadMessageStream
+		reader = messages.NewReader(bytes.NewReader(buffer.Bytes()))
+		stream, err := reader.ReadMessageStream(&param)
+		assert.NoError(err)
+		streamed, err := ioutil.ReadAll(stream)
+		assert.NoError(err)
+		assert.Equal(payload, streamed)
+
+		// Decompressed while resynchronizing
+		reader = messages.NewReader(bytes.NewReader(append([]byte("noise"), buffer.Bytes()...)))
+		reader.Resync = true
+		assert.NoError(reader.ReadMessage(&param, &binaryXML))
+		assert.Equal(payload, binaryXML)
+
+		// Decompressed size is subject to MaxMessageSize
+		reader = messages.NewReader(bytes.NewReader(buffer.Bytes()))
+		reader.MaxMessageSize = uint32(len(payload) - 1)
+		assert.Error(reader.ReadMessage(&param, &binaryXML))
+	}
+}
+
+func TestWriterCompressionThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	// Short payload
+	var buffer bytes.Buffer
+	writer := messages.NewWriter(&buffer)
+	writer.Compression = messages.CompressionGzip
+	assert.NoError(writer.WriteMessage(0, bytes.Repeat([]byte("x"), messages.DefaultCompressionThreshold-1)))
+	assert.Equal(frame(t, 0, bytes.Repeat([]byte("x"), messages.DefaultCompressionThreshold-1)), buffer.Bytes())
+
+	// Payload that doesn't shrink
+	buffer.Reset()
+	writer.CompressionThreshold = 0
+	assert.NoError(writer.WriteMessage(0, []byte("x")))
+	assert.Equal(frame(t, 0, []byte("x")), buffer.Bytes())
+}
+
+func TestWriterCompressionAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("Pooling is unreliable under the race detector")
+	}
+	payload := bytes.Repeat([]byte("<metric>Common_CPU</metric>"), 100)
+
+	// Codecs are reused rather than created for every message
+	for _, compression := range compressions {
+		var buffer bytes.Buffer
+		writer := messages.NewWriter(&buffer)
+		writer.Compression = compression
+		var binaryXML []byte
+		allocs := testing.AllocsPerRun(100, func() {
+			buffer.Reset()
+			if err := writer.WriteMessage(messages.ParamResponse, payload); err != nil {
+				t.Fatal(err)
+			}
+			var param uint8
+			reader := messages.NewReader(bytes.NewReader(buffer.Bytes()))
+			if err := reader.ReadMessage(&param, &binaryXML); err != nil {
+				t.Fatal(err)
+			}
+		})
+		assert.True(t, allocs <= 16, "%v: %v allocations", compression, allocs)
+	}
+}
@@ -3,12 +3,16 @@ package router
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"runtime/debug"
 	"strconv"
 	"strings"
 
 	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/messages"
 	"github.com/docktermj/go-logger/logger"
 	"github.com/jnewmoyer/xmlpath"
 )
@@ -24,11 +28,19 @@ type Request struct {
 	BinaryXML    []byte
 	Param        uint8
 	XMLPathNode  *xmlpath.Node
+
+	// Identity announced by the client in its handshake, if any
+	Identity string
 }
 
 func NewRequest(binaryXml []byte) (*Request, error) {
+	return NewRequestWithLimits(binaryXml, binaryxml.DefaultDecodeLimits)
+}
+
+// NewRequestWithLimits reads a request whose document must be within limits.
+func NewRequestWithLimits(binaryXml []byte, limits binaryxml.DecodeLimits) (*Request, error) {
 	// Populate XML field
-	xml, err := binaryxml.ToXML(binaryXml)
+	xml, err := binaryxml.ToXMLWithOptions(binaryXml, binaryxml.XMLOptions{Limits: limits})
 	if err != nil {
 		return nil, err
 	}
@@ -89,6 +101,17 @@ func (request *Request) Request() string {
 	return ""
 }
 
+// Envelope returns the BixRequest envelope fields of the request, without its payload.
+func (request *Request) Envelope() *binaryxml.BixRequest {
+	return &binaryxml.BixRequest{ToNamespace: request.Namespace(), Request: request.Request(), MOID: request.MOID(), MID: request.MID()}
+}
+
+// DecodeData decodes the payload carried in the Data element of a BixRequest into v.
+func (request *Request) DecodeData(v interface{}) error {
+	envelope := binaryxml.BixRequest{Data: v}
+	return binaryxml.Decode(request.BinaryXML, &envelope)
+}
+
 // ----------------------------------------------------------------------------
 // Router response
 // ----------------------------------------------------------------------------
@@ -108,11 +131,29 @@ type Context struct {
 	Request      *Request
 	Response     *Response
 	SendMoreFunc SendMoreFunc
+
+	// Cancelled once the request needn't be served anymore
+	ctx context.Context
 }
 
 func NewContext(request *Request) *Context {
+	return NewContextWithContext(context.Background(), request)
+}
+
+// NewContextWithContext returns the context of a request carrying parent, whose
+// cancellation and deadline reach handlers through Context.
+func NewContextWithContext(parent context.Context, request *Request) *Context {
 	response := &Response{}
-	return &Context{Request: request, Response: response}
+	return &Context{Request: request, Response: response, ctx: parent}
+}
+
+// Context returns the context.Context of the request, for handlers to pass on to
+// what they call. Servers cancel it when the connection of the request closes.
+func (ctx *Context) Context() context.Context {
+	if ctx.ctx == nil {
+		return context.Background()
+	}
+	return ctx.ctx
 }
 
 func (ctx *Context) Respond(v interface{}) error {
@@ -123,20 +164,32 @@ func (ctx *Context) Respond(v interface{}) error {
 	}
 	writer.Flush()
 	ctx.Response.BinaryXML = b.Bytes()
-	ctx.Response.Param = 1
+	ctx.Response.Param = messages.ParamResponse
 	return nil
 }
 
+// RespondMore sends an intermediate response flagged with messages.ParamMore, so
+// that subscribers know further responses to the same request will follow.
 func (ctx *Context) RespondMore(v interface{}) error {
 	if err := ctx.Respond(v); err != nil {
 		return err
 	}
+	ctx.Response.Param |= messages.ParamMore
 	return ctx.sendMore()
 }
 
+// RespondData responds with a BixResponse envelope correlated to the request, carrying data.
+func (ctx *Context) RespondData(data interface{}) error {
+	return ctx.Respond(ctx.Request.Envelope().NewResponse(data))
+}
+
+// RespondMoreData is the RespondMore counterpart of RespondData.
+func (ctx *Context) RespondMoreData(data interface{}) error {
+	return ctx.RespondMore(ctx.Request.Envelope().NewResponse(data))
+}
+
 func (ctx *Context) RespondError(message string) error {
-	bixError := binaryxml.BixError{FromNamespace: ctx.Request.Namespace(), Request: ctx.Request.Request(), MOID: ctx.Request.MOID(), MID: ctx.Request.MID(), Error: message}
-	return ctx.Respond(bixError)
+	return ctx.Respond(ctx.Request.Envelope().NewError(message))
 }
 
 func (ctx *Context) sendMore() error {
@@ -152,6 +205,76 @@ func (ctx *Context) sendMore() error {
 
 type HandlerFunc func(*Context) error
 
+var (
+	contextType = reflect.TypeOf((*Context)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// typedHandler adapts a handler of the form func(*Context, *Request) (*Response, error)
+// to a HandlerFunc, decoding the request payload and responding with the result.
+func typedHandler(handler interface{}) HandlerFunc {
+	fn := reflect.ValueOf(handler)
+	typ := fn.Type()
+	if typ.Kind() != reflect.Func || typ.NumIn() != 2 || typ.NumOut() != 2 ||
+		typ.In(0) != contextType || typ.In(1).Kind() != reflect.Ptr ||
+		typ.Out(0).Kind() != reflect.Ptr || typ.Out(1) != errorType {
+		panic(fmt.Sprintf("router: typed handler must be of the form func(*Context, *Request) (*Response, error), not %s", typ))
+	}
+	requestType := typ.In(1).Elem()
+	return func(ctx *Context) error {
+		req := reflect.New(requestType)
+		if err := ctx.Request.DecodeData(req.Interface()); err != nil {
+			return err
+		}
+		results := fn.Call([]reflect.Value{reflect.ValueOf(ctx), req})
+		if err, _ := results[1].Interface().(error); err != nil {
+			return err
+		}
+		return ctx.RespondData(results[0].Interface())
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Router error mapping
+// ----------------------------------------------------------------------------
+
+// ErrorMapperFunc maps an error returned by a handler to the BixError sent in
+// response. Returning nil falls back to the default mapping.
+type ErrorMapperFunc func(ctx *Context, err error) *binaryxml.BixError
+
+// PanicError is the error handled in place of a panicking handler.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.Value)
+}
+
+// CodedError is implemented by handler errors classifying their failure. The default
+// mapping sends their code along with their message.
+type CodedError interface {
+	error
+	ErrorCode() binaryxml.ErrorCode
+}
+
+// defaultErrorMapper sends the error message, except for panics whose details are
+// only logged. Errors are classified by their code when they have one, and expired
+// deadlines as timeouts.
+func defaultErrorMapper(ctx *Context, err error) *binaryxml.BixError {
+	if _, ok := err.(*PanicError); ok {
+		return ctx.Request.Envelope().NewErrorWithCode(binaryxml.ErrorCodeInternal, "Internal error")
+	}
+	var code binaryxml.ErrorCode
+	if codedErr, ok := err.(CodedError); ok {
+		code = codedErr.ErrorCode()
+	} else if err == context.DeadlineExceeded {
+		code = binaryxml.ErrorCodeTimeout
+	}
+	return ctx.Request.Envelope().NewErrorWithCode(code, err.Error())
+}
+
 // ----------------------------------------------------------------------------
 // Router
 // ----------------------------------------------------------------------------
@@ -160,12 +283,24 @@ type Router interface {
 	// Register a handler for a given xpath
 	Add(xpath string, handler HandlerFunc)
 
+	// Register a handler of the form func(*Context, *Request) (*Response, error) for a
+	// given xpath. The request payload is decoded from the Data element of the
+	// BixRequest, the response is sent as the payload of a BixResponse, and a returned
+	// error is handled as by Handle. Panics if handler is not of this form.
+	AddTyped(xpath string, handler interface{})
+
 	// Register a default handler for use when no others are registered for a given xpath
 	Default(handler HandlerFunc)
 
+	// Register a function mapping handler errors to BixError responses
+	MapErrors(mapper ErrorMapperFunc)
+
 	// Find a handler function to match the given request
 	findHandler(ctx *Context) HandlerFunc
 
+	// Invoke the handler matching the request. Panics are recovered, and when the
+	// handler fails without having sent a final response, ctx.Response is set to a
+	// BixError. The handler's error is returned.
 	Handle(ctx *Context) error
 }
 
@@ -174,6 +309,7 @@ type Router interface {
 type routerImpl struct {
 	registry       map[string]HandlerFunc
 	defaultHandler HandlerFunc
+	errorMapper    ErrorMapperFunc
 }
 
 func NewRouter() *routerImpl {
@@ -184,10 +320,18 @@ func (router *routerImpl) Add(xpath string, handler HandlerFunc) {
 	router.registry[xpath] = handler
 }
 
+func (router *routerImpl) AddTyped(xpath string, handler interface{}) {
+	router.Add(xpath, typedHandler(handler))
+}
+
 func (router *routerImpl) Default(handler HandlerFunc) {
 	router.defaultHandler = handler
 }
 
+func (router *routerImpl) MapErrors(mapper ErrorMapperFunc) {
+	router.errorMapper = mapper
+}
+
 func (router *routerImpl) findHandler(ctx *Context) HandlerFunc {
 	for xpath := range router.registry {
 		path := xmlpath.MustCompile(xpath)
@@ -199,13 +343,33 @@ func (router *routerImpl) findHandler(ctx *Context) HandlerFunc {
 	return router.defaultHandler
 }
 
-func (router *routerImpl) Handle(ctx *Context) error {
+func (router *routerImpl) Handle(ctx *Context) (err error) {
 	handler := router.findHandler(ctx)
 	topic := fmt.Sprintf("%s %s::%s", ctx.Request.Name(), ctx.Request.Namespace(), ctx.Request.Request())
 	if handler == nil {
 		logger.Warnf("No handler for %s", topic)
 		return nil
 	}
-	err := handler(ctx)
-	return err
+	defer func() {
+		if value := recover(); value != nil {
+			panicErr := &PanicError{Value: value, Stack: debug.Stack()}
+			logger.Errorf("Handler for %s panicked: %v\n%s", topic, value, panicErr.Stack)
+			err = panicErr
+		}
+		if err != nil && (ctx.Response.BinaryXML == nil || ctx.Response.Param&messages.ParamMore != 0) {
+			if respondErr := ctx.Respond(router.mapError(ctx, err)); respondErr != nil {
+				logger.Errorf("Failed responding with error for %s: %v", topic, respondErr)
+			}
+		}
+	}()
+	return handler(ctx)
+}
+
+func (router *routerImpl) mapError(ctx *Context, err error) *binaryxml.BixError {
+	if router.errorMapper != nil {
+		if bixError := router.errorMapper(ctx, err); bixError != nil {
+			return bixError
+		}
+	}
+	return defaultErrorMapper(ctx, err)
 }
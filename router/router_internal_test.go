@@ -1,12 +1,18 @@
 package router
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
 
 	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/messages"
 	"github.com/docktermj/go-logger/logger"
 	"github.com/stretchr/testify/assert"
 )
@@ -78,6 +84,18 @@ func TestRouteFixture1(t *testing.T) {
 	assert.Equal(false, otherHandler2Called)
 }
 
+func TestNewRequestWithLimits(t *testing.T) {
+	assert := assert.New(t)
+	binaryXml, err := ioutil.ReadFile("testdata/test-systemlib-1.binaryxml")
+	assert.NoError(err)
+
+	_, err = NewRequestWithLimits(binaryXml, binaryxml.DecodeLimits{MaxDepth: 1})
+	assert.Equal(&binaryxml.LimitError{Limit: "MaxDepth", Max: 1}, err)
+	request, err := NewRequestWithLimits(binaryXml, binaryxml.DecodeLimits{MaxDepth: 2})
+	assert.NoError(err)
+	assert.Equal("Testing", request.Request())
+}
+
 // ----------------------------------------------------------------------------
 
 func TestSetResponseError(t *testing.T) {
@@ -117,11 +135,236 @@ func TestRespondMore(t *testing.T) {
 	sendMoreFuncCalled := false
 	ctx.SendMoreFunc = func(ctx *Context) error {
 		sendMoreFuncCalled = true
+		assert.Equal(messages.ParamResponse|messages.ParamMore, ctx.Response.Param)
 		return nil
 	}
 	assert.NoError(ctx.RespondMore(bixResponse{Data: "partial"}))
+	assert.True(sendMoreFuncCalled)
 	ctx.Respond(bixResponse{Data: "done"})
+	assert.Equal(messages.ParamResponse, ctx.Response.Param)
 	xml, err := binaryxml.ToXML(ctx.Response.BinaryXML)
 	expected := "<BixResponse><Data>done</Data></BixResponse>"
 	assert.Equal(expected, xml)
 }
+
+// ----------------------------------------------------------------------------
+
+func TestRespondData(t *testing.T) {
+	assert := assert.New(t)
+	type query struct {
+		Namespace string `xml:"namespace"`
+	}
+	binaryXml, err := ioutil.ReadFile("testdata/test-systemlib-1.binaryxml")
+	assert.NoError(err)
+	request, err := NewRequest(binaryXml)
+	assert.NoError(err)
+	envelope := request.Envelope()
+	assert.Equal("VirtualMachines", envelope.ToNamespace)
+	assert.Equal("Testing", envelope.Request)
+	assert.Equal(uint64(6), envelope.MOID)
+	assert.Equal(uint64(1), envelope.MID)
+
+	ctx := NewContext(request)
+	assert.NoError(ctx.RespondData(query{Namespace: "foo"}))
+	xml, err := binaryxml.ToXML(ctx.Response.BinaryXML)
+	assert.NoError(err)
+	expected := "<BixResponse><fromNamespace>VirtualMachines</fromNamespace><request>Testing</request><moid>6</moid><mid>1</mid><Data><namespace>foo</namespace></Data></BixResponse>"
+	assert.Equal(expected, xml)
+
+	// Decode the payload of a request
+	var b bytes.Buffer
+	writer := bufio.NewWriter(&b)
+	assert.NoError(binaryxml.Encode(binaryxml.BixRequest{ToNamespace: "VirtualMachines", Data: query{Namespace: "foo"}}, writer))
+	writer.Flush()
+	request, err = NewRequest(b.Bytes())
+	assert.NoError(err)
+	var decoded query
+	assert.NoError(request.DecodeData(&decoded))
+	assert.Equal("foo", decoded.Namespace)
+}
+
+// ----------------------------------------------------------------------------
+
+type typedRequest struct {
+	Namespace string `xml:"namespace"`
+}
+
+type typedResponse struct {
+	Length int32 `xml:"length"`
+}
+
+func newTypedContext(t *testing.T, namespace string) *Context {
+	var b bytes.Buffer
+	writer := bufio.NewWriter(&b)
+	req := binaryxml.BixRequest{ToNamespace: "Typed", Request: "Length", MOID: 4, MID: 5, Data: typedRequest{Namespace: namespace}}
+	assert.NoError(t, binaryxml.Encode(req, writer))
+	writer.Flush()
+	request, err := NewRequest(b.Bytes())
+	assert.NoError(t, err)
+	return NewContext(request)
+}
+
+func TestAddTyped(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Typed'][request='Length']", func(ctx *Context, req *typedRequest) (*typedResponse, error) {
+		if req.Namespace == "" {
+			return nil, errors.New("namespace required")
+		}
+		return &typedResponse{Length: int32(len(req.Namespace))}, nil
+	})
+
+	// Successful response
+	ctx := newTypedContext(t, "abc")
+	assert.NoError(router.Handle(ctx))
+	xml, err := binaryxml.ToXML(ctx.Response.BinaryXML)
+	assert.NoError(err)
+	assert.Equal("<BixResponse><fromNamespace>Typed</fromNamespace><request>Length</request><moid>4</moid><mid>5</mid><Data><length>3</length></Data></BixResponse>", xml)
+
+	// Returned error
+	ctx = newTypedContext(t, "")
+	assert.Error(router.Handle(ctx))
+	xml, err = binaryxml.ToXML(ctx.Response.BinaryXML)
+	assert.NoError(err)
+	assert.Equal("<BixError><fromNamespace>Typed</fromNamespace><request>Length</request><moid>4</moid><mid>5</mid><error>namespace required</error></BixError>", xml)
+}
+
+func TestAddTypedRejectsInvalidHandler(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	assert.Panics(func() {
+		router.AddTyped("/BixRequest", func(ctx *Context) error { return nil })
+	})
+	assert.Panics(func() {
+		router.AddTyped("/BixRequest", func(ctx *Context, req typedRequest) (*typedResponse, error) { return nil, nil })
+	})
+	assert.Panics(func() {
+		router.AddTyped("/BixRequest", "not a function")
+	})
+}
+
+// ----------------------------------------------------------------------------
+
+func TestHandleError(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.Add("/BixRequest[toNamespace='Typed'][request='Length']", func(ctx *Context) error {
+		return errors.New("failed")
+	})
+	ctx := newTypedContext(t, "abc")
+	assert.EqualError(router.Handle(ctx), "failed")
+	xml, err := binaryxml.ToXML(ctx.Response.BinaryXML)
+	assert.NoError(err)
+	assert.Equal("<BixError><fromNamespace>Typed</fromNamespace><request>Length</request><moid>4</moid><mid>5</mid><error>failed</error></BixError>", xml)
+}
+
+func TestHandleErrorAfterResponding(t *testing.T) {
+	assert := assert.New(t)
+	type bixResponse struct {
+		XMLName struct{} `xml:"BixResponse"`
+		Data    string   `xml:"Data"`
+	}
+	router := NewRouter()
+	router.Add("/BixRequest[toNamespace='Typed'][request='Length']", func(ctx *Context) error {
+		ctx.Respond(bixResponse{Data: "done"})
+		return errors.New("failed after responding")
+	})
+	ctx := newTypedContext(t, "abc")
+	assert.Error(router.Handle(ctx))
+	xml, err := binaryxml.ToXML(ctx.Response.BinaryXML)
+	assert.NoError(err)
+	assert.Equal("<BixResponse><Data>done</Data></BixResponse>", xml)
+}
+
+func TestHandlePanic(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.Add("/BixRequest[toNamespace='Typed'][request='Length']", func(ctx *Context) error {
+		var registry map[string]int
+		registry["boom"]++
+		return nil
+	})
+	ctx := newTypedContext(t, "abc")
+	err := router.Handle(ctx)
+	assert.IsType(&PanicError{}, err)
+	assert.NotEmpty(err.(*PanicError).Stack)
+	xml, err := binaryxml.ToXML(ctx.Response.BinaryXML)
+	assert.NoError(err)
+	assert.Equal("<BixError><fromNamespace>Typed</fromNamespace><request>Length</request><moid>4</moid><mid>5</mid><error>Internal error</error><code>internal</code></BixError>", xml)
+}
+
+type quotaError struct {
+	limit int
+}
+
+func (err quotaError) Error() string {
+	return "quota exceeded"
+}
+
+type unavailableError struct{}
+
+func (err unavailableError) Error() string {
+	return "shutting down"
+}
+
+func (err unavailableError) ErrorCode() binaryxml.ErrorCode {
+	return binaryxml.ErrorCodeUnavailable
+}
+
+func TestHandleErrorCode(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Typed'][request='Length']", func(ctx *Context, req *typedRequest) (*typedResponse, error) {
+		if req.Namespace == "unavailable" {
+			return nil, unavailableError{}
+		}
+		return nil, context.DeadlineExceeded
+	})
+
+	// Errors carrying a code
+	ctx := newTypedContext(t, "unavailable")
+	assert.Error(router.Handle(ctx))
+	var bixError binaryxml.BixError
+	assert.NoError(binaryxml.Decode(ctx.Response.BinaryXML, &bixError))
+	assert.Equal(binaryxml.ErrorCodeUnavailable, bixError.Code)
+	assert.Equal("shutting down", bixError.Error)
+
+	// Expired deadlines
+	ctx = newTypedContext(t, "slow")
+	assert.Error(router.Handle(ctx))
+	bixError = binaryxml.BixError{}
+	assert.NoError(binaryxml.Decode(ctx.Response.BinaryXML, &bixError))
+	assert.Equal(binaryxml.ErrorCodeTimeout, bixError.Code)
+	assert.True(bixError.Code.Retryable())
+}
+
+func TestHandleErrorMapper(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.MapErrors(func(ctx *Context, err error) *binaryxml.BixError {
+		if quota, ok := err.(quotaError); ok {
+			return ctx.Request.Envelope().NewError(fmt.Sprintf("Quota of %d exceeded", quota.limit))
+		}
+		return nil
+	})
+	router.AddTyped("/BixRequest[toNamespace='Typed'][request='Length']", func(ctx *Context, req *typedRequest) (*typedResponse, error) {
+		if req.Namespace == "quota" {
+			return nil, quotaError{limit: 3}
+		}
+		return nil, errors.New("failed")
+	})
+
+	// Custom error type
+	ctx := newTypedContext(t, "quota")
+	assert.Error(router.Handle(ctx))
+	xml, err := binaryxml.ToXML(ctx.Response.BinaryXML)
+	assert.NoError(err)
+	assert.Equal("<BixError><fromNamespace>Typed</fromNamespace><request>Length</request><moid>4</moid><mid>5</mid><error>Quota of 3 exceeded</error></BixError>", xml)
+
+	// Fallback to default mapping
+	ctx = newTypedContext(t, "other")
+	assert.Error(router.Handle(ctx))
+	xml, err = binaryxml.ToXML(ctx.Response.BinaryXML)
+	assert.NoError(err)
+	assert.Equal("<BixError><fromNamespace>Typed</fromNamespace><request>Length</request><moid>4</moid><mid>5</mid><error>failed</error></BixError>", xml)
+}
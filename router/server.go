@@ -0,0 +1,393 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/docktermj/go-logger/logger"
+)
+
+// ErrHelloRequired rejects clients sending requests without a handshake, when the
+// server requires one.
+var ErrHelloRequired = errors.New("Handshake required")
+
+// Requests read ahead of the one being handled on a connection
+const requestQueueSize = 16
+
+// ----------------------------------------------------------------------------
+// Router server
+// ----------------------------------------------------------------------------
+
+// Server reads requests from connections, hands them to a Router, and writes the
+// responses back.
+type Server struct {
+	connectionID uint64 // accessed atomically; kept first for 64-bit alignment
+
+	Router Router
+
+	// Largest request accepted
+	MaxMessageSize uint32
+
+	// Limits of the documents of requests. Requests exceeding them are discarded.
+	DecodeLimits binaryxml.DecodeLimits
+
+	// Encoding of responses, which only use a checksum or compression the client
+	// accepts: the one it advertised in its hello, when Checksum isn't ChecksumCRC32 or
+	// Compression isn't CompressionNone, or the one of a request it sent. Other
+	// clients get crc32 checksummed, uncompressed responses.
+	messages.Options
+
+	// Intermediate responses sent with RespondMore are written in batches of up to
+	// MaxBatchSize bytes, held for at most MaxBatchLatency. Final responses flush them.
+	MaxBatchSize    int
+	MaxBatchLatency time.Duration
+
+	// Handshakes. Identity is announced to clients in answer to their hello.
+	// AcceptHello, if set, decides whether to serve a client from its hello, once its
+	// protocol version has been checked; returning an error rejects the client. With
+	// RequireHello, clients sending requests without a handshake are rejected.
+	Identity     string
+	AcceptHello  func(hello *binaryxml.BixHello) error
+	RequireHello bool
+}
+
+func NewServer(router Router) *Server {
+	return &Server{
+		Router:          router,
+		MaxMessageSize:  messages.DefaultMaxMessageSize,
+		DecodeLimits:    binaryxml.DefaultDecodeLimits,
+		Options:         messages.NewOptions(),
+		MaxBatchSize:    messages.DefaultMaxBatchSize,
+		MaxBatchLatency: messages.DefaultMaxBatchLatency,
+	}
+}
+
+// Serve accepts connections from listener, serving each of them in its own goroutine,
+// until the listener fails.
+func (server *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// ServeConn serves the requests read from conn, until the connection fails or is
+// closed by the client. The connection is closed on return. Requests are read into
+// pooled buffers, so the BinaryXML of a Request is only valid until its handler
+// returns; handlers that keep using it afterwards must copy it. Frames are read in
+// the background while requests are handled, so that pings are answered even while
+// a handler runs. Up to requestQueueSize requests are read ahead of the one being
+// handled. The Context of requests is cancelled once reading the connection fails.
+func (server *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	c := newConnection(server, conn)
+	defer c.writer.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	connCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Read frames, answering pings right away and queueing the others in order
+	requests := make(chan *messages.Message, requestQueueSize)
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(requests)
+		for {
+			msg, err := c.reader.Next()
+			if err != nil {
+				readErr = err
+				cancel()
+				return
+			}
+			if msg.Param == messages.ControlPing {
+				c.pong(msg.BinaryXML)
+				msg.Release()
+				continue
+			}
+			select {
+			case requests <- msg:
+			case <-done:
+				msg.Release()
+				return
+			}
+		}
+	}()
+
+	for msg := range requests {
+		if msg.Param&messages.ParamControl != 0 {
+			err := c.control(msg)
+			msg.Release()
+			if err != nil {
+				logger.Warnf("Closing connection from %s: %v", remoteAddr, err)
+				return err
+			}
+			continue
+		}
+		if c.hello == nil && server.RequireHello {
+			msg.Release()
+			logger.Warnf("Closing connection from %s: %v", remoteAddr, ErrHelloRequired)
+			c.reject(ErrHelloRequired)
+			return ErrHelloRequired
+		}
+		c.adopt(msg.Param)
+
+		request, err := NewRequestWithLimits(msg.BinaryXML, server.DecodeLimits)
+		if err != nil {
+			logger.Warnf("Rejecting malformed request from %s: %v", remoteAddr, err)
+			err = c.rejectRequest(msg.BinaryXML, err)
+			msg.Release()
+			if err != nil {
+				logger.Warnf("Failed responding to %s: %v", remoteAddr, err)
+				return err
+			}
+			continue
+		}
+		request.ConnectionID = c.id
+		request.RemoteAddr = remoteAddr
+		request.Param = msg.Param
+		if c.hello != nil {
+			request.Identity = c.hello.Identity
+		}
+
+		// Intermediate responses are sent as they are made, the final one once handled
+		ctx := NewContextWithContext(connCtx, request)
+		ctx.SendMoreFunc = c.send
+		if err := server.Router.Handle(ctx); err != nil {
+			logger.Debugf("Handler failed for request from %s: %v", remoteAddr, err)
+		}
+		msg.Release()
+		if ctx.Response.BinaryXML == nil || ctx.Response.Param&messages.ParamMore != 0 {
+			continue
+		}
+		err = c.send(ctx)
+		if tooLong, ok := err.(*messages.TooLongError); ok {
+			// Tell the client rather than sending what it would reject
+			logger.Warnf("Response to %s exceeds its limit of %d bytes", remoteAddr, tooLong.Max)
+			message := fmt.Sprintf("Response of %d bytes exceeds the client's limit of %d bytes", tooLong.Length, tooLong.Max)
+			if err = ctx.Respond(ctx.Request.Envelope().NewErrorWithCode(binaryxml.ErrorCodeInternal, message)); err == nil {
+				err = c.send(ctx)
+			}
+		}
+		if err != nil {
+			logger.Warnf("Failed responding to %s: %v", remoteAddr, err)
+			return err
+		}
+	}
+	if readErr == io.EOF {
+		return nil
+	}
+	logger.Warnf("Failed reading from %s: %v", remoteAddr, readErr)
+	return readErr
+}
+
+// hello returns the server's answer to a client's hello
+func (server *Server) hello() *binaryxml.BixHello {
+	return &binaryxml.BixHello{
+		Version:        messages.ProtocolVersion,
+		Params:         messages.SupportedParams,
+		MaxMessageSize: server.MaxMessageSize,
+		Identity:       server.Identity,
+	}
+}
+
+func (server *Server) acceptHello(hello *binaryxml.BixHello) error {
+	if hello.Version == 0 {
+		return fmt.Errorf("Unsupported protocol version %d", hello.Version)
+	}
+	if server.AcceptHello != nil {
+		return server.AcceptHello(hello)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+type connection struct {
+	// Set while a pong is being sent. Accessed atomically.
+	ponging int32
+
+	server *Server
+	id     uint64
+	reader *messages.Reader
+	hello  *binaryxml.BixHello
+
+	lock   sync.Mutex
+	writer *messages.BatchWriter
+
+	// Largest message the client accepts, from its hello, or 0 if unknown. Guarded by
+	// lock.
+	maxMessageSize uint32
+}
+
+func newConnection(server *Server, conn net.Conn) *connection {
+	c := &connection{
+		server: server,
+		id:     atomic.AddUint64(&server.connectionID, 1),
+		reader: messages.NewReader(bufio.NewReader(conn)),
+		writer: messages.NewBatchWriter(conn),
+	}
+	c.reader.MaxMessageSize = server.MaxMessageSize
+	c.writer.Options = server.Options
+	c.writer.Checksum = messages.ChecksumCRC32
+	c.writer.Compression = messages.CompressionNone
+	c.writer.MaxBatchSize = server.MaxBatchSize
+	c.writer.MaxBatchLatency = server.MaxBatchLatency
+	return c
+}
+
+// control handles a control frame, returning an error if the connection must be
+// closed.
+func (c *connection) control(msg *messages.Message) error {
+	switch msg.Param {
+	case messages.ControlHello:
+		return c.handshake(msg.BinaryXML)
+	}
+	logger.Debugf("Ignoring control frame %#x", msg.Param)
+	return nil
+}
+
+// pong answers a ping with the same payload, from a goroutine of its own so that the
+// reader isn't held up by responses being written. Pings arriving while a pong is
+// still being sent are dropped.
+func (c *connection) pong(payload []byte) {
+	if !atomic.CompareAndSwapInt32(&c.ponging, 0, 1) {
+		return
+	}
+	payload = append([]byte(nil), payload...)
+	go func() {
+		defer atomic.StoreInt32(&c.ponging, 0)
+		if err := c.write(messages.ControlPong, payload); err != nil {
+			logger.Debugf("Failed answering ping: %v", err)
+		}
+	}()
+}
+
+// handshake answers a client's hello, returning an error if the client is rejected
+func (c *connection) handshake(binaryXML []byte) error {
+	var hello binaryxml.BixHello
+	if err := binaryxml.Decode(binaryXML, &hello); err != nil {
+		c.reject(err)
+		return err
+	}
+	if err := c.server.acceptHello(&hello); err != nil {
+		c.reject(err)
+		return err
+	}
+	c.hello = &hello
+
+	// Only use the algorithms the client accepts, which are also the ones accepted
+	// from it
+	options := messages.Options{Checksum: messages.HelloChecksum(hello.Params), Compression: messages.HelloCompression(hello.Params)}
+	c.lock.Lock()
+	c.maxMessageSize = hello.MaxMessageSize
+	if c.server.Checksum != messages.ChecksumCRC32 {
+		c.writer.Checksum = options.Checksum
+	}
+	if c.server.Compression != messages.CompressionNone {
+		c.writer.Compression = options.Compression
+	}
+	c.lock.Unlock()
+
+	answer := c.server.hello()
+	answer.Params = options.HelloParams()
+	if hello.Version < answer.Version {
+		answer.Version = hello.Version
+	}
+	return c.sendHello(answer)
+}
+
+// reject the client with err, answering its hello
+func (c *connection) reject(err error) {
+	answer := c.server.hello()
+	answer.Error = err.Error()
+	if sendErr := c.sendHello(answer); sendErr != nil {
+		logger.Debugf("Failed rejecting client: %v", sendErr)
+	}
+}
+
+func (c *connection) sendHello(hello *binaryxml.BixHello) error {
+	var b bytes.Buffer
+	writer := bufio.NewWriter(&b)
+	if err := binaryxml.Encode(hello, writer); err != nil {
+		return err
+	}
+	writer.Flush()
+	return c.write(messages.ControlHello, b.Bytes())
+}
+
+// write a control frame, flushing pending responses along with it
+func (c *connection) write(param uint8, payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.writer.WriteMessage(param, payload); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// adopt the checksum and compression of a request for subsequent responses
+func (c *connection) adopt(param uint8) {
+	checksum := messages.ParamChecksum(param)
+	compression := messages.ParamCompression(param)
+	if checksum == messages.ChecksumCRC32 && compression == messages.CompressionNone {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if checksum != messages.ChecksumCRC32 {
+		c.writer.Checksum = checksum
+	}
+	if compression != messages.CompressionNone {
+		c.writer.Compression = compression
+	}
+}
+
+// rejectRequest answers a request that failed to decode with a BixError, carrying
+// the mid of the request if it can be found, so that the client's call fails rather
+// than waiting for a response.
+func (c *connection) rejectRequest(binaryXML []byte, err error) error {
+	code := binaryxml.ErrorCodeInvalidRequest
+	if _, ok := err.(*binaryxml.LimitError); ok {
+		code = binaryxml.ErrorCodeLimitExceeded
+	}
+	bixError := &binaryxml.BixError{Error: err.Error(), Code: code}
+	if _, mid, err := binaryxml.EnvelopeMID(binaryXML); err == nil {
+		bixError.MID = mid
+	}
+	ctx := NewContext(&Request{BinaryXML: binaryXML})
+	if err := ctx.Respond(bixError); err != nil {
+		return err
+	}
+	return c.send(ctx)
+}
+
+// send queues intermediate responses, and flushes them along with final ones.
+// Responses larger than the client accepts fail with a *messages.TooLongError.
+func (c *connection) send(ctx *Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if length := len(ctx.Response.BinaryXML); c.maxMessageSize != 0 && uint64(length) > uint64(c.maxMessageSize) {
+		return &messages.TooLongError{Length: uint32(length), Max: c.maxMessageSize}
+	}
+	if err := c.writer.WriteMessage(ctx.Response.Param, ctx.Response.BinaryXML); err != nil {
+		return err
+	}
+	if ctx.Response.Param&messages.ParamMore != 0 {
+		return nil
+	}
+	return c.writer.Flush()
+}
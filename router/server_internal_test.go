@@ -0,0 +1,372 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/client"
+	"github.com/BixData/binaryxml/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+type metricDump struct {
+	Metrics string `xml:"metrics"`
+}
+
+func serve(t *testing.T, server *Server) (*client.Client, func()) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	bixClient, err := client.Connect("127.0.0.1", listener.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bixClient, func() {
+		bixClient.Conn.Close()
+		listener.Close()
+	}
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		return req, nil
+	})
+	bixClient, closeClient := serve(t, NewServer(router))
+	defer closeClient()
+
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: "Common_CPU"}}
+	var res metricDump
+	assert.NoError(bixClient.Call(context.Background(), req, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal("Common_CPU", res.Metrics)
+}
+
+func TestServerCompression(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		assert.Equal(messages.CompressionZstd, messages.ParamCompression(ctx.Request.Param))
+		return req, nil
+	})
+	bixClient, closeClient := serve(t, NewServer(router))
+	defer closeClient()
+
+	// Responses follow the compression of requests
+	bixClient.Compression = messages.CompressionZstd
+	dump := metricDump{Metrics: strings.Repeat("Common_CPU ", 500)}
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &dump}
+	assert.NoError(bixClient.Send(0, req))
+	var param uint8
+	var res metricDump
+	assert.NoError(bixClient.Receive(&param, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal(messages.CompressionZstd, messages.ParamCompression(param))
+	assert.Equal(dump, res)
+}
+
+func TestServerCompressionNegotiation(t *testing.T) {
+	assert := assert.New(t)
+	dump := metricDump{Metrics: strings.Repeat("Common_CPU ", 500)}
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Dump']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		return &dump, nil
+	})
+	server := NewServer(router)
+	server.Compression = messages.CompressionZstd
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Dump", MID: 1, Data: &metricDump{}}
+
+	// Clients that didn't advertise compression get uncompressed responses
+	bixClient, closeClient := serve(t, server)
+	defer closeClient()
+	assert.NoError(bixClient.Send(0, req))
+	var param uint8
+	var res metricDump
+	assert.NoError(bixClient.Receive(&param, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal(messages.CompressionNone, messages.ParamCompression(param))
+	assert.Equal(dump, res)
+
+	// Clients that did get responses compressed with the algorithm they advertised
+	bixClient, closeClient = serve(t, server)
+	defer closeClient()
+	bixClient.Compression = messages.CompressionGzip
+	answer, err := bixClient.Handshake(context.Background(), "collector")
+	assert.NoError(err)
+	assert.Equal(messages.CompressionGzip, messages.HelloCompression(answer.Params))
+	assert.Equal(messages.CompressionGzip, bixClient.Compression)
+	assert.NoError(bixClient.Send(0, req))
+	assert.NoError(bixClient.Receive(&param, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal(messages.CompressionGzip, messages.ParamCompression(param))
+	assert.Equal(dump, res)
+}
+
+func TestServerRespondMore(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		for i := 0; i < 3; i++ {
+			if err := ctx.RespondMoreData(req); err != nil {
+				return nil, err
+			}
+		}
+		return req, nil
+	})
+	server := NewServer(router)
+	server.MaxBatchLatency = time.Hour
+	bixClient, closeClient := serve(t, server)
+	defer closeClient()
+
+	// Intermediate responses are held until the final one
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: "Common_CPU"}}
+	assert.NoError(bixClient.Send(0, req))
+	for i := 0; i < 4; i++ {
+		var param uint8
+		var res metricDump
+		assert.NoError(bixClient.Receive(&param, &binaryxml.BixResponse{Data: &res}))
+		assert.Equal(i < 3, param&messages.ParamMore != 0)
+		assert.Equal("Common_CPU", res.Metrics)
+	}
+}
+
+func TestServerChecksum(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		return req, nil
+	})
+	bixClient, closeClient := serve(t, NewServer(router))
+	defer closeClient()
+
+	// Responses follow the checksum of requests
+	bixClient.Checksum = messages.ChecksumCRC32C
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: "Common_CPU"}}
+	assert.NoError(bixClient.Send(0, req))
+	var param uint8
+	var res metricDump
+	assert.NoError(bixClient.Receive(&param, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal(messages.ChecksumCRC32C, messages.ParamChecksum(param))
+	assert.Equal("Common_CPU", res.Metrics)
+}
+
+func TestServerChecksumNegotiation(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		return req, nil
+	})
+	server := NewServer(router)
+	server.Checksum = messages.ChecksumXXHash64
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: "Common_CPU"}}
+
+	// Clients that didn't advertise a checksum get crc32
+	bixClient, closeClient := serve(t, server)
+	defer closeClient()
+	assert.NoError(bixClient.Send(0, req))
+	var param uint8
+	var res metricDump
+	assert.NoError(bixClient.Receive(&param, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal(messages.ChecksumCRC32, messages.ParamChecksum(param))
+
+	// Clients that did get the checksum they advertised, rather than the server's
+	bixClient, closeClient = serve(t, server)
+	defer closeClient()
+	bixClient.Checksum = messages.ChecksumCRC32C
+	answer, err := bixClient.Handshake(context.Background(), "collector")
+	assert.NoError(err)
+	assert.Equal(messages.ChecksumCRC32C, messages.HelloChecksum(answer.Params))
+	assert.Equal(messages.ChecksumCRC32C, bixClient.Checksum)
+	bixClient.Checksum = messages.ChecksumCRC32
+	assert.NoError(bixClient.Send(0, req))
+	assert.NoError(bixClient.Receive(&param, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal(messages.ChecksumCRC32C, messages.ParamChecksum(param))
+	assert.Equal("Common_CPU", res.Metrics)
+}
+
+func TestServerHandshake(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		assert.Equal("collector", ctx.Request.Identity)
+		return req, nil
+	})
+	server := NewServer(router)
+	server.Identity = "router"
+	server.RequireHello = true
+	bixClient, closeClient := serve(t, server)
+	defer closeClient()
+
+	answer, err := bixClient.Handshake(context.Background(), "collector")
+	assert.NoError(err)
+	assert.Equal(messages.ProtocolVersion, answer.Version)
+	assert.Equal(messages.SupportedParams&^(messages.ParamCompressionMask|messages.ParamChecksumMask), answer.Params)
+	assert.Equal(messages.DefaultMaxMessageSize, answer.MaxMessageSize)
+	assert.Equal("router", answer.Identity)
+
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: "Common_CPU"}}
+	var res metricDump
+	assert.NoError(bixClient.Call(context.Background(), req, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal("Common_CPU", res.Metrics)
+}
+
+func TestServerRejectHello(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(NewRouter())
+	server.AcceptHello = func(hello *binaryxml.BixHello) error {
+		return fmt.Errorf("Unknown client %s", hello.Identity)
+	}
+	bixClient, closeClient := serve(t, server)
+	defer closeClient()
+
+	_, err := bixClient.Handshake(context.Background(), "intruder")
+	assert.EqualError(err, "Unknown client intruder")
+}
+
+func TestServerRequireHello(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(NewRouter())
+	server.RequireHello = true
+	bixClient, closeClient := serve(t, server)
+	defer closeClient()
+
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1}
+	var res metricDump
+	err := bixClient.Call(context.Background(), req, &binaryxml.BixResponse{Data: &res})
+	assert.EqualError(err, ErrHelloRequired.Error())
+}
+
+func TestServerKeepalive(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		return req, nil
+	})
+	bixClient, closeClient := serve(t, NewServer(router))
+	defer closeClient()
+
+	// The server's pongs keep an idle connection open beyond the timeout
+	bixClient.KeepaliveInterval = 10 * time.Millisecond
+	bixClient.KeepaliveTimeout = 30 * time.Millisecond
+	assert.NoError(bixClient.SendRaw(messages.ControlPing, nil))
+	time.Sleep(100 * time.Millisecond)
+
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: "Common_CPU"}}
+	var res metricDump
+	assert.NoError(bixClient.Call(context.Background(), req, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal("Common_CPU", res.Metrics)
+}
+
+func TestServerKeepaliveDuringHandler(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		time.Sleep(200 * time.Millisecond)
+		return req, nil
+	})
+	bixClient, closeClient := serve(t, NewServer(router))
+	defer closeClient()
+
+	// Pings are answered while a handler runs for longer than the timeout
+	bixClient.KeepaliveInterval = 10 * time.Millisecond
+	bixClient.KeepaliveTimeout = 50 * time.Millisecond
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: "Common_CPU"}}
+	var res metricDump
+	assert.NoError(bixClient.Call(context.Background(), req, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal("Common_CPU", res.Metrics)
+}
+
+func TestServerCancelsContextOnClose(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		close(started)
+		<-ctx.Context().Done()
+		close(cancelled)
+		return nil, ctx.Context().Err()
+	})
+	bixClient, closeClient := serve(t, NewServer(router))
+	defer closeClient()
+
+	// A handler waiting on its context returns once the client goes away
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: "Common_CPU"}}
+	assert.NoError(bixClient.Send(0, req))
+	<-started
+	bixClient.Conn.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail("Context not cancelled")
+	}
+}
+
+func TestServerPeerMaxMessageSize(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		return req, nil
+	})
+	bixClient, closeClient := serve(t, NewServer(router))
+	defer closeClient()
+	conn := bixClient.Conn
+	write := func(param uint8, v interface{}) {
+		var buffer bytes.Buffer
+		writer := bufio.NewWriter(&buffer)
+		assert.NoError(binaryxml.Encode(v, writer))
+		writer.Flush()
+		assert.NoError(messages.WriteMessage(conn, param, buffer.Bytes()))
+	}
+
+	// A client accepting messages of up to 200 bytes
+	write(messages.ControlHello, binaryxml.BixHello{Version: messages.ProtocolVersion, MaxMessageSize: 200})
+	var param uint8
+	var binaryXML []byte
+	assert.NoError(messages.ReadMessage(conn, &param, &binaryXML))
+	assert.Equal(messages.ControlHello, param)
+
+	// Gets an error instead of a larger response
+	write(0, binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: strings.Repeat("x", 200)}})
+	assert.NoError(messages.ReadMessage(conn, &param, &binaryXML))
+	var bixError binaryxml.BixError
+	assert.NoError(binaryxml.Decode(binaryXML, &bixError))
+	assert.Equal(binaryxml.ErrorCodeInternal, bixError.Code)
+	assert.Contains(bixError.Error, "exceeds the client's limit of 200 bytes")
+	assert.True(len(binaryXML) <= 200)
+}
+
+func TestServerDecodeLimits(t *testing.T) {
+	assert := assert.New(t)
+	router := NewRouter()
+	router.AddTyped("/BixRequest[toNamespace='Metrics'][request='Echo']", func(ctx *Context, req *metricDump) (*metricDump, error) {
+		return req, nil
+	})
+	server := NewServer(router)
+	assert.Equal(binaryxml.DefaultDecodeLimits, server.DecodeLimits)
+	server.DecodeLimits.MaxStringLength = 16
+	bixClient, closeClient := serve(t, server)
+	defer closeClient()
+
+	// Requests exceeding the limits fail with a BixError, without closing the connection
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req := binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 1, Data: &metricDump{Metrics: strings.Repeat("x", 17)}}
+	var res metricDump
+	err := bixClient.Call(ctx, req, &binaryxml.BixResponse{Data: &res})
+	if remoteErr, ok := err.(*client.RemoteError); assert.True(ok, "%v", err) {
+		assert.Equal(binaryxml.ErrorCodeLimitExceeded, remoteErr.Code)
+		assert.Equal(uint64(1), remoteErr.MID)
+		assert.Equal("binaryxml: document exceeds MaxStringLength of 16", remoteErr.Message)
+	}
+
+	req = binaryxml.BixRequest{ToNamespace: "Metrics", Request: "Echo", MID: 2, Data: &metricDump{Metrics: "Common_CPU"}}
+	assert.NoError(bixClient.Call(context.Background(), req, &binaryxml.BixResponse{Data: &res}))
+	assert.Equal("Common_CPU", res.Metrics)
+}
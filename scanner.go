@@ -0,0 +1,332 @@
+package binaryxml
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+var typeNames = map[BinXMLType]string{
+	undefinedtype: "undefined",
+	nodetype:      "node",
+	int1btype:     "int1b",
+	uint1btype:    "uint1b",
+	int2btype:     "int2b",
+	uint2btype:    "uint2b",
+	int4btype:     "int4b",
+	uint4btype:    "uint4b",
+	int8btype:     "int8b",
+	uint8btype:    "uint8b",
+	float4type:    "float4",
+	strtype:       "str",
+	binarytype:    "binary",
+	endtagtype:    "endtag",
+	tablebegin:    "table begin",
+	tableend:      "table end",
+	serialbegin:   "serial begin",
+	serialend:     "serial end",
+}
+
+// String returns the name of a type tag, as used in dumps.
+func (t BinXMLType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown type %d", uint8(t))
+}
+
+// ----------------------------------------------------------------------------
+// Scanner
+// ----------------------------------------------------------------------------
+
+// tableEntry is an element name declared in the table section
+type tableEntry struct {
+	Offset int
+	Key    uint16
+	Name   string
+}
+
+// token is an item of the serial section. Elements start with a token of their type,
+// carrying the value of typed elements, and end with an endtagtype token.
+type token struct {
+	Offset int
+	Type   BinXMLType
+	Key    uint16
+	Name   string
+	Value  interface{}
+	Depth  int
+}
+
+// scanner reads the table and serial sections of a binary XML document, keeping
+// track of the offset of everything it reads. It is the one reader of documents,
+// behind ToXML, Dump, Validate and the conversions to other formats, so that they
+// all accept the same documents.
+type scanner struct {
+	data     []byte
+	offset   int
+	table    []tableEntry
+	names    map[uint16]string
+	stack    []string
+	elements int
+
+	// Limits of the document, checked as it is read
+	limits DecodeLimits
+
+	// Type of the token being read, reported by syntax errors
+	token BinXMLType
+
+	// Called with the offset and description of every item read by readTable
+	trace func(offset int, format string, args ...interface{})
+
+	// Called with errors the scanner can continue past, such as unknown keys or
+	// missing markers, instead of returning them
+	recover func(offset int, err error)
+}
+
+func newScanner(data []byte) *scanner {
+	return &scanner{data: data, names: make(map[uint16]string)}
+}
+
+// readTable reads the table section, up to the serial begin marker.
+func (s *scanner) readTable() error {
+	if err := checkLimit("MaxSize", s.limits.MaxSize, len(s.data)); err != nil {
+		return err
+	}
+	if err := s.expect(tablebegin); err != nil {
+		return err
+	}
+	s.token = tablebegin
+	offset := s.offset
+	var tableLength uint16
+	if err := s.read(&tableLength); err != nil {
+		return err
+	}
+	s.traceHeader(offset, "table length %d", tableLength)
+	for key := uint16(1); key <= tableLength && key != 0; key++ {
+		offset := s.offset
+		name, err := s.readString()
+		if err != nil {
+			return err
+		}
+		s.table = append(s.table, tableEntry{Offset: offset, Key: key, Name: name})
+		s.names[key] = name
+		s.traceHeader(offset, "table entry %d %q", key, name)
+		if !isXMLName(name) {
+			if err := s.recoverable(offset, "invalid element name %q", name); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.expect(tableend); err != nil {
+		return err
+	}
+	return s.expect(serialbegin)
+}
+
+func (s *scanner) traceHeader(offset int, format string, args ...interface{}) {
+	if s.trace != nil {
+		s.trace(offset, format, args...)
+	}
+}
+
+// next returns the next token of the serial section, or io.EOF once the serial end
+// marker has been read. The serial section holds a single root element. Tokens the
+// scanner recovers from are skipped in a loop, however many there are.
+func (s *scanner) next() (token, error) {
+	for {
+		t := token{Offset: s.offset, Depth: len(s.stack)}
+		s.token = undefinedtype
+		if err := s.read(&t.Type); err != nil {
+			return t, err
+		}
+		s.token = t.Type
+		switch {
+		case t.Type == serialend:
+			if len(s.stack) > 0 {
+				if err := s.recoverable(t.Offset, "serial end with %d unclosed elements", len(s.stack)); err != nil {
+					return t, err
+				}
+				s.stack = nil
+			}
+			if s.elements == 0 {
+				if err := s.recoverable(t.Offset, "missing root element"); err != nil {
+					return t, err
+				}
+			}
+			return t, io.EOF
+		case t.Type == endtagtype:
+			if len(s.stack) == 0 {
+				if err := s.recoverable(t.Offset, "too many close element tags"); err != nil {
+					return t, err
+				}
+				continue
+			}
+			t.Depth--
+			t.Name = s.stack[len(s.stack)-1]
+			s.stack = s.stack[:len(s.stack)-1]
+			return t, nil
+		case !isElementType(t.Type):
+			if err := s.recoverable(t.Offset, "unexpected %v token", t.Type); err != nil {
+				return t, err
+			}
+			continue
+		}
+		return s.element(t)
+	}
+}
+
+// element reads the key and value of an element started by t
+func (s *scanner) element(t token) (token, error) {
+	if len(s.stack) == 0 && s.elements > 0 {
+		if err := s.recoverable(t.Offset, "more than one root element"); err != nil {
+			return t, err
+		}
+	}
+
+	if err := s.read(&t.Key); err != nil {
+		return t, err
+	}
+	name, ok := s.names[t.Key]
+	if !ok {
+		if err := s.recoverError(t.Offset, &UnknownElementIDError{Offset: t.Offset, ID: t.Key}); err != nil {
+			return t, err
+		}
+		name = "?"
+	}
+	t.Name = name
+	s.stack = append(s.stack, name)
+	s.elements++
+	if err := checkLimit("MaxDepth", s.limits.MaxDepth, len(s.stack)); err != nil {
+		return t, err
+	}
+	if err := checkLimit("MaxElements", s.limits.MaxElements, s.elements); err != nil {
+		return t, err
+	}
+	value, err := s.readValue(t.Type)
+	t.Value = value
+	return t, err
+}
+
+func (s *scanner) readValue(dataType BinXMLType) (interface{}, error) {
+	switch dataType {
+	case int1btype:
+		var value int8
+		err := s.read(&value)
+		return value, err
+	case uint1btype:
+		var value uint8
+		err := s.read(&value)
+		return value, err
+	case int2btype:
+		var value int16
+		err := s.read(&value)
+		return value, err
+	case uint2btype:
+		var value uint16
+		err := s.read(&value)
+		return value, err
+	case int4btype:
+		var value int32
+		err := s.read(&value)
+		return value, err
+	case uint4btype:
+		var value uint32
+		err := s.read(&value)
+		return value, err
+	case int8btype:
+		var value int64
+		err := s.read(&value)
+		return value, err
+	case uint8btype:
+		var value uint64
+		err := s.read(&value)
+		return value, err
+	case float4type:
+		var value float32
+		err := s.read(&value)
+		return value, err
+	case strtype:
+		// Strings are UTF-8 on the wire, and their bytes are kept as they are, for
+		// writers to replace what isn't UTF-8
+		return s.readString()
+	case binarytype:
+		var length uint32
+		if err := s.read(&length); err != nil {
+			return nil, err
+		}
+		if err := checkLimit("MaxBinaryLength", s.limits.MaxBinaryLength, int(length)); err != nil {
+			return nil, err
+		}
+		if uint64(length) > uint64(len(s.data)-s.offset) {
+			return nil, s.malformed(s.offset, "binary length %d exceeds the remaining %d bytes", length, len(s.data)-s.offset)
+		}
+		value := s.data[s.offset : s.offset+int(length)]
+		s.offset += int(length)
+		return value, nil
+	}
+	return nil, nil
+}
+
+// expect reads a marker token. A missing marker leaves the offset unchanged, so
+// that scanning can recover by reading what is there instead.
+func (s *scanner) expect(marker BinXMLType) error {
+	offset := s.offset
+	s.token = marker
+	var t BinXMLType
+	if err := s.read(&t); err != nil {
+		return err
+	}
+	if t != marker {
+		s.offset = offset
+		return s.recoverable(offset, "missing %v token", marker)
+	}
+	s.traceHeader(offset, "%v", marker)
+	return nil
+}
+
+// read a fixed size big endian value
+func (s *scanner) read(value interface{}) error {
+	size := binary.Size(value)
+	if size > len(s.data)-s.offset {
+		s.offset = len(s.data)
+		return s.malformed(s.offset, "unexpected end of input")
+	}
+	binary.Read(bytes.NewReader(s.data[s.offset:s.offset+size]), binary.BigEndian, value)
+	s.offset += size
+	return nil
+}
+
+// readString reads the bytes of a string up to its terminating NUL
+func (s *scanner) readString() (string, error) {
+	end := bytes.IndexByte(s.data[s.offset:], 0)
+	if end < 0 {
+		s.offset = len(s.data)
+		return "", s.malformed(s.offset, "unterminated string")
+	}
+	if err := checkLimit("MaxStringLength", s.limits.MaxStringLength, end); err != nil {
+		return "", err
+	}
+	value := string(s.data[s.offset : s.offset+end])
+	s.offset += end + 1
+	return value, nil
+}
+
+// recoverable reports an error to recover, returning nil, or returns it if the
+// scanner doesn't recover from errors
+func (s *scanner) recoverable(offset int, format string, args ...interface{}) error {
+	return s.recoverError(offset, s.malformed(offset, format, args...))
+}
+
+func (s *scanner) recoverError(offset int, err error) error {
+	if s.recover == nil {
+		return err
+	}
+	s.recover(offset, err)
+	return nil
+}
+
+// malformed returns a SyntaxError at offset in the token being read
+func (s *scanner) malformed(offset int, format string, args ...interface{}) error {
+	return &SyntaxError{Offset: offset, Token: s.token, Msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,211 @@
+package binaryxml
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// JSONOptions configures conversions to JSON.
+type JSONOptions struct {
+	// PreserveTypes writes typed values as objects naming their type, such as
+	// {"@type":"uint4b","value":60}, and the children of elements whose children
+	// of a name aren't adjacent as an ordered "@children" array, so that FromJSON
+	// gives back the same document
+	PreserveTypes bool
+
+	// Limits bounds the resources converting a document may use. Documents exceeding
+	// them fail with a LimitError.
+	Limits DecodeLimits
+}
+
+// ToJSON converts a binary XML document to JSON, as an object whose only key is the
+// root element. Elements with children become objects keyed by the names of their
+// children, and children sharing a name become an array, in the place of the first
+// of them. Integers and floats become numbers, strings remain strings, and binary
+// values become base64 strings. Elements with neither children nor value become
+// empty objects. Floats JSON can't represent, NaN and infinities, become strings.
+// Documents exceeding DefaultDecodeLimits fail with a LimitError.
+func ToJSON(data []byte) (string, error) {
+	return ToJSONWithOptions(data, JSONOptions{Limits: DefaultDecodeLimits})
+}
+
+// ToJSONWithOptions converts a binary XML document to JSON like ToJSON. With
+// PreserveTypes, values other than strings are written as objects whose "@type" is
+// the name of their type and whose "value" is their value as ToJSON writes it.
+// Elements whose children of a name are interleaved with others, which grouping by
+// name would reorder, write them under "@children", as an array of objects each
+// holding one child, in document order. This makes the conversion lossless.
+func ToJSONWithOptions(data []byte, options JSONOptions) (string, error) {
+	root, err := readTree(data, options.Limits)
+	if err != nil {
+		return "", err
+	}
+	writer := jsonWriter{options: options}
+	writer.buffer.WriteByte('{')
+	if err := writer.member(root.Name, []*treeElement{root}); err != nil {
+		return "", err
+	}
+	writer.buffer.WriteByte('}')
+	return writer.buffer.String(), nil
+}
+
+// ----------------------------------------------------------------------------
+// JSON
+// ----------------------------------------------------------------------------
+
+const (
+	// Key of the type of typed values, when preserving types
+	jsonTypeKey = "@type"
+
+	// Key of the value of typed values, when preserving types
+	jsonTypedValueKey = "value"
+
+	// Key of the value of a typed element that also has children
+	jsonValueKey = "#value"
+
+	// Key of the children of an element in document order, when preserving types
+	jsonChildrenKey = "@children"
+)
+
+type jsonWriter struct {
+	buffer  bytes.Buffer
+	options JSONOptions
+}
+
+func (w *jsonWriter) member(name string, elements []*treeElement) error {
+	if err := w.value(name); err != nil {
+		return err
+	}
+	w.buffer.WriteByte(':')
+	if len(elements) == 1 {
+		return w.element(elements[0])
+	}
+	w.buffer.WriteByte('[')
+	for i, element := range elements {
+		if i > 0 {
+			w.buffer.WriteByte(',')
+		}
+		if err := w.element(element); err != nil {
+			return err
+		}
+	}
+	w.buffer.WriteByte(']')
+	return nil
+}
+
+func (w *jsonWriter) element(element *treeElement) error {
+	typed := w.options.PreserveTypes && element.Type != nodetype && element.Type != strtype
+	if len(element.Children) == 0 && element.Type != nodetype {
+		if !typed {
+			return w.value(element.Value)
+		}
+		w.buffer.WriteByte('{')
+		if err := w.typedValue(element, jsonTypedValueKey); err != nil {
+			return err
+		}
+		w.buffer.WriteByte('}')
+		return nil
+	}
+
+	// Group children by name, in order of first appearance
+	var names []string
+	children := make(map[string][]*treeElement)
+	interleaved := false
+	for i, child := range element.Children {
+		if _, ok := children[child.Name]; !ok {
+			names = append(names, child.Name)
+		} else if child.Name != element.Children[i-1].Name {
+			interleaved = true
+		}
+		children[child.Name] = append(children[child.Name], child)
+	}
+
+	w.buffer.WriteByte('{')
+	if typed {
+		if err := w.typedValue(element, jsonValueKey); err != nil {
+			return err
+		}
+		w.buffer.WriteByte(',')
+	} else if element.Type != nodetype {
+		if err := w.value(jsonValueKey); err != nil {
+			return err
+		}
+		w.buffer.WriteByte(':')
+		if err := w.value(element.Value); err != nil {
+			return err
+		}
+		w.buffer.WriteByte(',')
+	}
+	if interleaved && w.options.PreserveTypes {
+		if err := w.orderedChildren(element.Children); err != nil {
+			return err
+		}
+		w.buffer.WriteByte('}')
+		return nil
+	}
+	for i, name := range names {
+		if i > 0 {
+			w.buffer.WriteByte(',')
+		}
+		if err := w.member(name, children[name]); err != nil {
+			return err
+		}
+	}
+	w.buffer.WriteByte('}')
+	return nil
+}
+
+// orderedChildren writes children as an "@children" array, in document order
+func (w *jsonWriter) orderedChildren(children []*treeElement) error {
+	if err := w.value(jsonChildrenKey); err != nil {
+		return err
+	}
+	w.buffer.WriteString(":[")
+	for i, child := range children {
+		if i > 0 {
+			w.buffer.WriteByte(',')
+		}
+		w.buffer.WriteByte('{')
+		if err := w.member(child.Name, []*treeElement{child}); err != nil {
+			return err
+		}
+		w.buffer.WriteByte('}')
+	}
+	w.buffer.WriteByte(']')
+	return nil
+}
+
+// typedValue writes the type and value members of a typed element
+func (w *jsonWriter) typedValue(element *treeElement, valueKey string) error {
+	if err := w.value(jsonTypeKey); err != nil {
+		return err
+	}
+	w.buffer.WriteByte(':')
+	if err := w.value(element.Type.String()); err != nil {
+		return err
+	}
+	w.buffer.WriteByte(',')
+	if err := w.value(valueKey); err != nil {
+		return err
+	}
+	w.buffer.WriteByte(':')
+	return w.value(element.Value)
+}
+
+// value writes a leaf value. Floats JSON can't represent are written as strings.
+func (w *jsonWriter) value(value interface{}) error {
+	if f, ok := value.(float32); ok && (math.IsNaN(float64(f)) || math.IsInf(float64(f), 0)) {
+		value = strconv.FormatFloat(float64(f), 'g', -1, 32)
+	}
+	encoder := json.NewEncoder(&w.buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+
+	// Drop the newline ending encoded values
+	w.buffer.Truncate(w.buffer.Len() - 1)
+	return nil
+}
@@ -0,0 +1,48 @@
+package binaryxml_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+type jsonFixture struct {
+	XMLName struct{}          `xml:"Inventory"`
+	Count   uint32            `xml:"count"`
+	Items   []jsonFixtureItem `xml:"item"`
+	Owner   string            `xml:"owner"`
+}
+
+type jsonFixtureItem struct {
+	Name string `xml:"name"`
+}
+
+func TestToJSONWithBinaryFixture1(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := ioutil.ReadFile("testdata/test-systemlib-1.binaryxml")
+	assert.NoError(err)
+
+	json, err := binaryxml.ToJSON(binaryXML)
+	assert.NoError(err)
+	assert.Equal(`{"BixRequest":{"toNamespace":"VirtualMachines","request":"Testing","moid":"6","mid":"1"}}`, json)
+}
+
+func TestToJSONWithTypedAndRepeatedElements(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	fixture := jsonFixture{Count: 60, Items: []jsonFixtureItem{{"a"}, {"<b>"}}, Owner: "me"}
+	assert.NoError(binaryxml.NewEncoder(&buffer).Encode(&fixture))
+
+	json, err := binaryxml.ToJSON(buffer.Bytes())
+	assert.NoError(err)
+	assert.Equal(`{"Inventory":{"count":60,"item":[{"name":"a"},{"name":"<b>"}],"owner":"me"}}`, json)
+}
+
+func TestToJSONWithMalformedInput(t *testing.T) {
+	assert := assert.New(t)
+	_, err := binaryxml.ToJSON([]byte{0x7c, 0x00})
+	assert.Error(err)
+}
@@ -1,213 +1,338 @@
 package binaryxml
 
 import (
+	"bufio"
 	"bytes"
-	"container/list"
 	"encoding/base64"
-	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
-const malformedErrorStr = "Content is not valid binary XML; %s"
+// Digits written after the decimal point of floats, unless configured otherwise
+const DefaultFloatPrecision = 10
 
+// XMLOptions configures conversions to XML. The zero value converts like ToXML,
+// but without limits.
+type XMLOptions struct {
+	// Indent is written once per level of nesting before every element, which then
+	// starts a line of its own. An empty Indent writes the document on a single line.
+	Indent string
+
+	// Declaration writes an XML declaration before the root element
+	Declaration bool
+
+	// SelfClose writes elements with neither children nor value as <name/>
+	SelfClose bool
+
+	// Escape selects how values are escaped
+	Escape EscapePolicy
+
+	// FloatPrecision is the number of digits written after the decimal point of
+	// floats. Zero writes DefaultFloatPrecision digits, and a negative precision the
+	// fewest digits that represent the float exactly.
+	FloatPrecision int
+
+	// Binary selects the encoding of binary values
+	Binary BinaryEncoding
+
+	// Limits bounds the resources converting a document may use. Documents exceeding
+	// them fail with a LimitError.
+	Limits DecodeLimits
+}
+
+// EscapePolicy selects how values are escaped in XML.
+type EscapePolicy uint8
+
+const (
+	// EscapeMarkup escapes the characters &, < and >, which would otherwise be read
+	// as markup, and carriage returns, which XML parsers would read as newlines.
+	// Characters XML can't represent are replaced by U+FFFD.
+	EscapeMarkup EscapePolicy = iota
+
+	// EscapeAll escapes values like encoding/xml, escaping quotes and whitespace other
+	// than spaces too, and replacing characters XML can't represent
+	EscapeAll
+
+	// EscapeNone writes values as they are, which makes invalid XML of values
+	// holding markup
+	EscapeNone
+)
+
+// BinaryEncoding selects the encoding of binary values in XML.
+type BinaryEncoding uint8
+
+const (
+	BinaryBase64 BinaryEncoding = iota
+	BinaryHex
+)
+
+// ToXML converts a binary XML document to XML, on a single line, escaping values,
+// within DefaultDecodeLimits.
 func ToXML(data []byte) (string, error) {
-	reader := bytes.NewReader(data)
+	return ToXMLWithOptions(data, XMLOptions{Limits: DefaultDecodeLimits})
+}
 
-	// Read table begin marker
-	var token BinXMLType
-	if err := binary.Read(reader, binary.BigEndian, &token); err != nil {
+// ToXMLWithOptions converts a binary XML document to XML as configured by options.
+// Configured with an Indent of two spaces, a Declaration and SelfClose, it writes
+// documents like the golden .xml files of the testdata directory.
+func ToXMLWithOptions(data []byte, options XMLOptions) (string, error) {
+	var buffer bytes.Buffer
+	if err := WriteXML(&buffer, data, options); err != nil {
 		return "", err
 	}
-	if token != tablebegin {
-		return "", fmt.Errorf(malformedErrorStr, "missing table begin token")
-	}
+	return buffer.String(), nil
+}
 
-	// Read table length
-	var tableLength uint16
-	if err := binary.Read(reader, binary.BigEndian, &tableLength); err != nil {
-		return "", err
+// WriteXML converts a binary XML document to XML as configured by options, writing
+// elements as they are read. Output written before an error is found in the document
+// is left in place.
+func WriteXML(w io.Writer, data []byte, options XMLOptions) error {
+	s := newScanner(data)
+	s.limits = options.Limits
+	if err := s.readTable(); err != nil {
+		return err
 	}
 
-	// Read table
-	elementNamesById := make(map[uint16]string)
-	for i := uint16(1); i <= tableLength; i++ {
-		name, err := readNullTerminatedString(reader)
+	// Write serial section
+	writer := newXMLWriter(w, options)
+	if options.Declaration {
+		writer.declaration()
+	}
+	for {
+		t, err := s.next()
+		if err == io.EOF {
+			return writer.flush()
+		}
 		if err != nil {
-			return "", err
+			writer.flush()
+			return err
+		}
+		if t.Type == endtagtype {
+			writer.end(t.Name)
+			continue
+		}
+		writer.start(t.Name)
+		switch value := t.Value.(type) {
+		case nil:
+		case string:
+			writer.value(value)
+		case float32:
+			writer.float(value)
+		case []byte:
+			writer.binary(value)
+		default:
+			writer.value(fmt.Sprintf("%d", value))
 		}
-		elementNamesById[i] = name
 	}
+}
 
-	// Read table end marker
-	if err := binary.Read(reader, binary.BigEndian, &token); err != nil {
-		return "", err
+func isElementType(x BinXMLType) bool {
+	if x == nodetype || x == int1btype || x == int2btype || x == int4btype || x == int8btype {
+		return true
 	}
-	if token != tableend {
-		return "", fmt.Errorf(malformedErrorStr, "missing table end token")
+	if x == uint1btype || x == uint2btype || x == uint4btype || x == uint8btype {
+		return true
 	}
+	if x == float4type || x == strtype || x == binarytype {
+		return true
+	}
+	return false
+}
 
-	// Read serial begin marker
-	if err := binary.Read(reader, binary.BigEndian, &token); err != nil {
-		return "", err
+// ----------------------------------------------------------------------------
+// XML writer
+// ----------------------------------------------------------------------------
+
+// xmlWriter writes elements as configured by options. Start tags are left open
+// until the next element starts, or the element ends, to know whether the element
+// has children or is empty.
+type xmlWriter struct {
+	writer  *bufio.Writer
+	options XMLOptions
+	depth   int
+
+	// Whether the start tag of the current element is open, and the value to
+	// write after it
+	open bool
+	text string
+}
+
+func newXMLWriter(w io.Writer, options XMLOptions) *xmlWriter {
+	return &xmlWriter{writer: bufio.NewWriter(w), options: options}
+}
+
+func (w *xmlWriter) declaration() {
+	w.writer.WriteString(`<?xml version="1.0"?>`)
+	w.newline()
+}
+
+func (w *xmlWriter) start(name string) {
+	if w.open {
+		w.closeStartTag()
+		w.newline()
 	}
-	if token != serialbegin {
-		return "", fmt.Errorf(malformedErrorStr, "missing serial begin token")
+	w.indent()
+	w.writer.WriteString("<" + name)
+	w.open = true
+	w.text = ""
+	w.depth++
+}
+
+// value sets the value of the current element
+func (w *xmlWriter) value(text string) {
+	switch w.options.Escape {
+	case EscapeMarkup:
+		text = escapeMarkup(text)
+	case EscapeAll:
+		var buffer bytes.Buffer
+		xml.EscapeText(&buffer, []byte(text))
+		text = buffer.String()
 	}
+	w.text = text
+}
 
-	// Read serial section
-	var xmlBuffer bytes.Buffer
-	//xmlBuffer.WriteString("<?xml version=\"1.0\"?>\n")
-	if err := readSerialSection(reader, elementNamesById, &xmlBuffer); err != nil {
-		return "", err
+func (w *xmlWriter) float(value float32) {
+	precision := w.options.FloatPrecision
+	if precision == 0 {
+		precision = DefaultFloatPrecision
+	} else if precision < 0 {
+		precision = -1
 	}
+	w.value(strconv.FormatFloat(float64(value), 'f', precision, 32))
+}
 
-	return xmlBuffer.String(), nil
+func (w *xmlWriter) binary(value []byte) {
+	switch w.options.Binary {
+	case BinaryHex:
+		w.value(hex.EncodeToString(value))
+	default:
+		w.value(base64.StdEncoding.EncodeToString(value))
+	}
 }
 
-func readNullTerminatedString(reader io.Reader) (string, error) {
-	var buffer bytes.Buffer
-	for {
-		var byte uint8
-		if err := binary.Read(reader, binary.BigEndian, &byte); err != nil {
-			return "", err
-		}
-		if byte == 0 {
-			break
+func (w *xmlWriter) end(name string) {
+	w.depth--
+	if w.open {
+		w.open = false
+		if w.text == "" && w.options.SelfClose {
+			w.writer.WriteString("/>")
+		} else {
+			w.writer.WriteString(">" + w.text + "</" + name + ">")
 		}
-		buffer.WriteString(string(byte))
+	} else {
+		w.indent()
+		w.writer.WriteString("</" + name + ">")
 	}
-	return buffer.String(), nil
+	w.newline()
 }
 
-func readSerialSection(reader io.Reader, elementNamesById map[uint16]string, response *bytes.Buffer) error {
-	elementNameStack := list.New()
-	for {
-		// Read datatype
-		var dataType BinXMLType
-		if err := binary.Read(reader, binary.BigEndian, &dataType); err != nil {
-			return err
-		}
+// flush writes what is buffered, closing a start tag left open by an unclosed element
+func (w *xmlWriter) flush() error {
+	if w.open {
+		w.closeStartTag()
+	}
+	return w.writer.Flush()
+}
 
-		// Detect serial end marker
-		if dataType == serialend {
-			return nil
-		}
+func (w *xmlWriter) closeStartTag() {
+	w.writer.WriteString(">" + w.text)
+	w.open = false
+}
 
-		// Write begin of element
-		if isElementType(dataType) {
-			var key uint16
-			if err := binary.Read(reader, binary.BigEndian, &key); err != nil {
-				return err
-			}
-			elementName, ok := elementNamesById[key]
-			if !ok {
-				return fmt.Errorf(malformedErrorStr, "no table entry for key")
-			}
-			elementNameStack.PushFront(elementName)
-			response.WriteString("<" + elementName + ">")
-		}
+func (w *xmlWriter) indent() {
+	if w.options.Indent != "" {
+		w.writer.WriteString(strings.Repeat(w.options.Indent, w.depth))
+	}
+}
 
-		// Write element value
-		switch dataType {
-		case binarytype:
-			var length uint32
-			if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
-				return err
-			}
-			value := make([]byte, length)
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			// writing base64 encoded version of value
-			response.Write([]byte(base64.StdEncoding.EncodeToString(value)))
-		case float4type:
-			var value float32
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(strconv.FormatFloat(float64(value), 'f', 10, 32))
-		case int1btype:
-			var value int8
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(fmt.Sprintf("%d", value))
-		case nodetype:
-		case uint1btype:
-			var value uint8
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(fmt.Sprintf("%d", value))
-		case int2btype:
-			var value int16
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(fmt.Sprintf("%d", value))
-		case strtype:
-			value, err := readNullTerminatedString(reader)
-			if err != nil {
-				return err
-			}
-			response.WriteString(value)
-		case uint2btype:
-			var value uint16
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(fmt.Sprintf("%d", value))
-		case int4btype:
-			var value int32
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(fmt.Sprintf("%d", value))
-		case uint4btype:
-			var value uint32
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(fmt.Sprintf("%d", value))
-		case int8btype:
-			var value int64
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(fmt.Sprintf("%d", value))
-		case uint8btype:
-			var value uint64
-			if err := binary.Read(reader, binary.BigEndian, &value); err != nil {
-				return err
-			}
-			response.WriteString(fmt.Sprintf("%d", value))
-		}
+func (w *xmlWriter) newline() {
+	if w.options.Indent != "" {
+		w.writer.WriteByte('\n')
+	}
+}
 
-		// Write end of element
-		if dataType == endtagtype {
-			element := elementNameStack.Front()
-			if element == nil {
-				return fmt.Errorf(malformedErrorStr, "too many close element tags")
-			}
-			elementName := element.Value.(string)
-			elementNameStack.Remove(element)
-			response.WriteString("</" + elementName + ">")
+// ----------------------------------------------------------------------------
+// XML text and names
+// ----------------------------------------------------------------------------
+
+func escapeMarkup(text string) string {
+	var buffer bytes.Buffer
+	last := 0
+	for i, r := range text {
+		var escaped string
+		switch {
+		case r == '&':
+			escaped = "&amp;"
+		case r == '<':
+			escaped = "&lt;"
+		case r == '>':
+			escaped = "&gt;"
+		case r == '\r':
+			escaped = "&#xD;"
+		case r == utf8.RuneError || !isXMLChar(r):
+			escaped = "\uFFFD"
+		default:
+			continue
 		}
+		_, size := utf8.DecodeRuneInString(text[i:])
+		buffer.WriteString(text[last:i])
+		buffer.WriteString(escaped)
+		last = i + size
+	}
+	if last == 0 {
+		return text
 	}
-	return nil
+	buffer.WriteString(text[last:])
+	return buffer.String()
 }
 
-func isElementType(x BinXMLType) bool {
-	if x == nodetype || x == int1btype || x == int2btype || x == int4btype || x == int8btype {
-		return true
-	}
-	if x == uint1btype || x == uint2btype || x == uint4btype || x == uint8btype {
-		return true
+// isXMLChar reports whether r is a character of the XML 1.0 Char production
+func isXMLChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+// isXMLName reports whether name is valid UTF-8 matching the XML 1.0 Name production
+func isXMLName(name string) bool {
+	if name == "" || !utf8.ValidString(name) {
+		return false
 	}
-	if x == float4type || x == strtype || x == binarytype {
-		return true
+	for i, r := range name {
+		if !isXMLNameStartChar(r) && (i == 0 || !isXMLNameChar(r)) {
+			return false
+		}
 	}
-	return false
+	return true
+}
+
+func isXMLNameStartChar(r rune) bool {
+	return r == ':' || r == '_' ||
+		r >= 'A' && r <= 'Z' ||
+		r >= 'a' && r <= 'z' ||
+		r >= 0xC0 && r <= 0xD6 ||
+		r >= 0xD8 && r <= 0xF6 ||
+		r >= 0xF8 && r <= 0x2FF ||
+		r >= 0x370 && r <= 0x37D ||
+		r >= 0x37F && r <= 0x1FFF ||
+		r >= 0x200C && r <= 0x200D ||
+		r >= 0x2070 && r <= 0x218F ||
+		r >= 0x2C00 && r <= 0x2FEF ||
+		r >= 0x3001 && r <= 0xD7FF ||
+		r >= 0xF900 && r <= 0xFDCF ||
+		r >= 0xFDF0 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0xEFFFF
+}
+
+func isXMLNameChar(r rune) bool {
+	return r == '-' || r == '.' || r == 0xB7 ||
+		r >= '0' && r <= '9' ||
+		r >= 0x300 && r <= 0x36F ||
+		r >= 0x203F && r <= 0x2040
 }
@@ -1,12 +1,16 @@
 package binaryxml_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"strings"
 	"testing"
 
 	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
 	"github.com/tdewolff/minify"
 	"github.com/tdewolff/minify/xml"
 )
@@ -76,3 +80,209 @@ func doToXMLTest(fixtureName string, t *testing.T) {
 		t.Errorf("Failed converting binary xml; expected %s; got %s", expectedXml, xml)
 	}
 }
+
+type xmlOptionsFixture struct {
+	XMLName struct{} `xml:"Options"`
+	Text    string   `xml:"text"`
+	Float   float32  `xml:"float"`
+	Data    []byte   `xml:"data"`
+}
+
+// Converting with golden options gives the golden files byte for byte
+func TestToXMLWithOptionsMatchesGoldenFiles(t *testing.T) {
+	assert := assert.New(t)
+	options := binaryxml.XMLOptions{Indent: "  ", Declaration: true, SelfClose: true}
+	for i := 1; i <= 6; i++ {
+		fixture := fmt.Sprintf("testdata/test-systemlib-%d", i)
+		binaryXML, err := ioutil.ReadFile(fixture + ".binaryxml")
+		assert.NoError(err)
+		golden, err := ioutil.ReadFile(fixture + ".xml")
+		assert.NoError(err)
+
+		xml, err := binaryxml.ToXMLWithOptions(binaryXML, options)
+		assert.NoError(err)
+		assert.Equal(string(golden), xml, fixture)
+	}
+}
+
+func TestToXMLWithOptions(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	fixture := xmlOptionsFixture{Text: "a < b & \"c\"", Float: 0.1, Data: []byte{0x00, 0x7f, 0x80, 0xff}}
+	assert.NoError(binaryxml.NewEncoder(&buffer).Encode(&fixture))
+	binaryXML := buffer.Bytes()
+
+	xml, err := binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{})
+	assert.NoError(err)
+	assert.Equal(`<Options><text>a &lt; b &amp; "c"</text><float>0.1000000015</float><data>AH+A/w==</data></Options>`, xml)
+
+	xml, err = binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{
+		Escape:         binaryxml.EscapeNone,
+		FloatPrecision: -1,
+		Binary:         binaryxml.BinaryHex,
+	})
+	assert.NoError(err)
+	assert.Equal(`<Options><text>a < b & "c"</text><float>0.1</float><data>007f80ff</data></Options>`, xml)
+
+	xml, err = binaryxml.ToXMLWithOptions(binaryXML, binaryxml.XMLOptions{
+		Indent:         "\t",
+		Declaration:    true,
+		Escape:         binaryxml.EscapeAll,
+		FloatPrecision: 2,
+	})
+	assert.NoError(err)
+	assert.Equal("<?xml version=\"1.0\"?>\n<Options>\n"+
+		"\t<text>a &lt; b &amp; &#34;c&#34;</text>\n"+
+		"\t<float>0.10</float>\n"+
+		"\t<data>AH+A/w==</data>\n"+
+		"</Options>\n", xml)
+}
+
+type failingWriter struct {
+	written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	return 0, errors.New("write failed")
+}
+
+func TestWriteXML(t *testing.T) {
+	assert := assert.New(t)
+	binaryXML, err := ioutil.ReadFile("testdata/test-systemlib-2.binaryxml")
+	assert.NoError(err)
+	xml, err := binaryxml.ToXML(binaryXML)
+	assert.NoError(err)
+
+	var buffer bytes.Buffer
+	assert.NoError(binaryxml.WriteXML(&buffer, binaryXML, binaryxml.XMLOptions{}))
+	assert.Equal(xml, buffer.String())
+
+	// Write errors are returned
+	assert.EqualError(binaryxml.WriteXML(&failingWriter{}, binaryXML, binaryxml.XMLOptions{}), "write failed")
+
+	// Elements read before an error in the document are written
+	buffer.Reset()
+	assert.Error(binaryxml.WriteXML(&buffer, binaryXML[:len(binaryXML)-20], binaryxml.XMLOptions{}))
+	assert.True(strings.HasPrefix(xml, buffer.String()))
+	assert.True(strings.HasPrefix(buffer.String(), "<BixRequest><toNamespace>SubscriptionProvider</toNamespace>"))
+}
+
+type escapeFixture struct {
+	XMLName struct{} `xml:"Escape"`
+	Text    string   `xml:"text"`
+}
+
+// Strings holding markup, entities or whitespace XML parsers normalize survive
+// Encode, ToXML and Decode
+func TestToXMLEscapesValues(t *testing.T) {
+	assert := assert.New(t)
+	values := []string{
+		"",
+		"<",
+		"&",
+		"]]>",
+		"</text>",
+		"<![CDATA[text]]>",
+		"&amp;",
+		"&#60;",
+		"<!-- comment -->",
+		"<?pi?>",
+		`"quoted" and 'quoted'`,
+		"line\r\nbreaks\rand\ttabs\n",
+		" spaces ",
+	}
+
+	// Strings of random characters of XML markup
+	random := rand.New(rand.NewSource(1))
+	const alphabet = "<>&;#x![]-?/\"' \t\r\nCDATAamplt"
+	for i := 0; i < 500; i++ {
+		value := make([]byte, random.Intn(24))
+		for j := range value {
+			value[j] = alphabet[random.Intn(len(alphabet))]
+		}
+		values = append(values, string(value))
+	}
+
+	for _, value := range values {
+		var buffer bytes.Buffer
+		assert.NoError(binaryxml.NewEncoder(&buffer).Encode(&escapeFixture{Text: value}))
+		decoded := escapeFixture{}
+		if assert.NoError(binaryxml.Decode(buffer.Bytes(), &decoded), "%q", value) {
+			assert.Equal(value, decoded.Text)
+		}
+	}
+}
+
+// Characters XML can't represent are replaced, keeping the document valid
+func TestToXMLReplacesInvalidCharacters(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	assert.NoError(binaryxml.NewEncoder(&buffer).Encode(&escapeFixture{Text: "a\x01b\x1f"}))
+	decoded := escapeFixture{}
+	assert.NoError(binaryxml.Decode(buffer.Bytes(), &decoded))
+	assert.Equal("a\uFFFDb\uFFFD", decoded.Text)
+}
+
+func TestToXMLRejectsInvalidElementNames(t *testing.T) {
+	assert := assert.New(t)
+	for _, name := range []string{"1a", "a b", "a<b", "-a", ".a", "a>"} {
+		binaryXML := []byte{0x7c, 0x00, 0x01}
+		binaryXML = append(binaryXML, name...)
+		binaryXML = append(binaryXML, 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x0d, 0x7f)
+		_, err := binaryxml.ToXML(binaryXML)
+		assert.EqualError(err, fmt.Sprintf("Content is not valid binary XML; invalid element name %q at offset 3", name))
+		assert.Equal(err, binaryxml.Validate(binaryXML), name)
+	}
+
+	// Names of other characters of the XML name rules are valid
+	for _, name := range []string{"a", "_a", "a-1.b", "a:b", "A_9"} {
+		binaryXML := []byte{0x7c, 0x00, 0x01}
+		binaryXML = append(binaryXML, name...)
+		binaryXML = append(binaryXML, 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x0d, 0x7f)
+		_, err := binaryxml.ToXML(binaryXML)
+		assert.NoError(err, name)
+	}
+
+	_, err := binaryxml.FromJSON(`{"a":{"b c":"x"}}`)
+	assert.EqualError(err, `binaryxml: invalid element name "b c"`)
+}
+
+type utf8Fixture struct {
+	XMLName struct{} `xml:"Café"`
+	Text    string   `xml:"texte"`
+	Name    string   `xml:"名前"`
+}
+
+// Strings are UTF-8 on the wire, and keep their multi-byte characters
+func TestToXMLWithUTF8(t *testing.T) {
+	assert := assert.New(t)
+	values := []string{"é", "日本語", "emoji 😀", "mixed é<&>ü", strings.Repeat("é", 5000)}
+	for _, value := range values {
+		var buffer bytes.Buffer
+		fixture := utf8Fixture{Text: value, Name: value}
+		assert.NoError(binaryxml.NewEncoder(&buffer).Encode(&fixture))
+
+		decoded := utf8Fixture{}
+		if assert.NoError(binaryxml.Decode(buffer.Bytes(), &decoded)) {
+			assert.Equal(fixture, decoded)
+		}
+	}
+
+	var buffer bytes.Buffer
+	assert.NoError(binaryxml.NewEncoder(&buffer).Encode(&utf8Fixture{Text: "é"}))
+	xml, err := binaryxml.ToXML(buffer.Bytes())
+	assert.NoError(err)
+	assert.Equal("<Café><texte>é</texte><名前></名前></Café>", xml)
+}
+
+// Bytes that aren't UTF-8 are replaced, keeping the document valid
+func TestToXMLReplacesInvalidUTF8(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	assert.NoError(binaryxml.NewEncoder(&buffer).Encode(&escapeFixture{Text: "caf\xe9 \xc3"}))
+	decoded := escapeFixture{}
+	assert.NoError(binaryxml.Decode(buffer.Bytes(), &decoded))
+	assert.Equal("caf\uFFFD \uFFFD", decoded.Text)
+	assert.NoError(binaryxml.Validate(buffer.Bytes()))
+}
@@ -0,0 +1,136 @@
+package binaryxml
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Validate checks that data is a well-formed binary XML document: a table, followed
+// by a serial section holding a single root element, whose elements are all named
+// in the table and closed. It accepts the documents ToXML converts, ignoring bytes
+// following the serial end marker, and strings that aren't UTF-8, which conversions
+// replace. Documents exceeding DefaultDecodeLimits fail with a LimitError.
+func Validate(data []byte) error {
+	_, err := readTree(data, DefaultDecodeLimits)
+	return err
+}
+
+// ----------------------------------------------------------------------------
+// Element tree
+// ----------------------------------------------------------------------------
+
+// treeElement is an element of a document held in memory, for conversions between
+// binary XML and other formats. Value holds the value of typed elements, as read
+// by a scanner.
+type treeElement struct {
+	Type     BinXMLType
+	Name     string
+	Value    interface{}
+	Children []*treeElement
+}
+
+// readTree reads a binary XML document into a tree of elements, within limits
+func readTree(data []byte, limits DecodeLimits) (*treeElement, error) {
+	s := newScanner(data)
+	s.limits = limits
+	if err := s.readTable(); err != nil {
+		return nil, err
+	}
+	var root *treeElement
+	var stack []*treeElement
+	for {
+		t, err := s.next()
+		if err == io.EOF {
+			return root, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t.Type == endtagtype {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		element := &treeElement{Type: t.Type, Name: t.Name, Value: t.Value}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, element)
+		} else {
+			root = element
+		}
+		stack = append(stack, element)
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Writes a tree
+// ----------------------------------------------------------------------------
+
+// writeTree writes a binary XML document
+func writeTree(buffer *bytes.Buffer, root *treeElement) error {
+	// Number element names in order of first appearance
+	keys := make(map[string]uint16)
+	var names []string
+	var number func(element *treeElement)
+	number = func(element *treeElement) {
+		if _, ok := keys[element.Name]; !ok {
+			names = append(names, element.Name)
+			keys[element.Name] = uint16(len(names))
+		}
+		for _, child := range element.Children {
+			number(child)
+		}
+	}
+	number(root)
+	for _, name := range names {
+		if !isXMLName(name) {
+			return fmt.Errorf("binaryxml: invalid element name %q", name)
+		}
+	}
+	if len(names) > math.MaxUint16 {
+		return fmt.Errorf("binaryxml: %d element names exceed the table capacity", len(names))
+	}
+
+	binary.Write(buffer, binary.BigEndian, tablebegin)
+	binary.Write(buffer, binary.BigEndian, uint16(len(names)))
+	for _, name := range names {
+		buffer.WriteString(name)
+		buffer.WriteByte(0)
+	}
+	binary.Write(buffer, binary.BigEndian, tableend)
+	binary.Write(buffer, binary.BigEndian, serialbegin)
+	if err := writeTreeElement(buffer, root, keys); err != nil {
+		return err
+	}
+	return binary.Write(buffer, binary.BigEndian, serialend)
+}
+
+func writeTreeElement(buffer *bytes.Buffer, element *treeElement, keys map[string]uint16) error {
+	binary.Write(buffer, binary.BigEndian, element.Type)
+	binary.Write(buffer, binary.BigEndian, keys[element.Name])
+	switch value := element.Value.(type) {
+	case nil:
+	case string:
+		if strings.IndexByte(value, 0) >= 0 {
+			return &ElementError{Element: element.Name, Err: ErrNULCharacter}
+		}
+		buffer.WriteString(value)
+		buffer.WriteByte(0)
+	case []byte:
+		binary.Write(buffer, binary.BigEndian, uint32(len(value)))
+		buffer.Write(value)
+	default:
+		if err := binary.Write(buffer, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	for _, child := range element.Children {
+		if err := writeTreeElement(buffer, child, keys); err != nil {
+			return err
+		}
+	}
+	return binary.Write(buffer, binary.BigEndian, endtagtype)
+}
@@ -0,0 +1,36 @@
+package binaryxml_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BixData/binaryxml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFixtures(t *testing.T) {
+	assert := assert.New(t)
+	for i := 1; i <= 6; i++ {
+		fixture := fmt.Sprintf("testdata/test-systemlib-%d.binaryxml", i)
+		binaryXML, err := ioutil.ReadFile(fixture)
+		assert.NoError(err)
+		assert.NoError(binaryxml.Validate(binaryXML), fixture)
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	assert := assert.New(t)
+	for name, binaryXML := range map[string][]byte{
+		"empty":           {},
+		"no table":        {0x7e, 0x7f},
+		"no root":         {0x7c, 0x00, 0x00, 0x7d, 0x7e, 0x7f},
+		"unknown key":     {0x7c, 0x00, 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x0d, 0x7f},
+		"unclosed":        {0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x7f},
+		"extra endtag":    {0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x0d, 0x0d, 0x7f},
+		"two roots":       {0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x01, 0x00, 0x01, 0x0d, 0x01, 0x00, 0x01, 0x0d, 0x7f},
+		"truncated value": {0x7c, 0x00, 0x01, 'a', 0x00, 0x7d, 0x7e, 0x07, 0x00, 0x01, 0x00},
+	} {
+		assert.Error(binaryxml.Validate(binaryXML), name)
+	}
+}